@@ -7,5 +7,18 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		lib.CtlFunc(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "probe" {
+		lib.ProbeFunc(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "netns" {
+		lib.NetNsFunc(os.Args[2:])
+		return
+	}
+
 	lib.MainFunc(os.Args)
 }
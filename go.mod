@@ -3,12 +3,30 @@ module github.com/isodude/gopipe
 go 1.21.5
 
 require (
+	github.com/containerd/containerd/api v1.8.0
 	github.com/coreos/go-systemd/v22 v22.5.0
-	github.com/ftrvxmtrx/fd v0.0.0-20150925145434-c6d800382fff
+	github.com/elastic/go-seccomp-bpf v1.5.0
+	github.com/godbus/dbus/v5 v5.0.4
 	github.com/jessevdk/go-flags v1.5.0
+	github.com/vishvananda/netlink v1.3.0
 	github.com/vishvananda/netns v0.0.4
+	golang.org/x/net v0.24.0
 	golang.org/x/sync v0.7.0
-	golang.org/x/sys v0.2.0
+	golang.org/x/sys v0.19.0
+	google.golang.org/grpc v1.59.0
+	k8s.io/cri-api v0.29.0
+	kernel.org/pub/linux/libs/security/libcap/psx v1.2.71
 )
 
-require github.com/godbus/dbus/v5 v5.0.4 // indirect
+require (
+	github.com/containerd/log v0.1.0 // indirect
+	github.com/containerd/ttrpc v1.2.5 // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/opencontainers/go-digest v1.0.0 // indirect
+	github.com/opencontainers/image-spec v1.1.0 // indirect
+	github.com/sirupsen/logrus v1.9.3 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240401170217-c3f982113cda // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+)
@@ -57,12 +57,6 @@ func (a *Addr) GetListener(tlsConfig *tls.Config) (net.Listener, error) {
 	if err != nil {
 		return nil, fmt.Errorf("not implemented yet: %v", err)
 	}
-	// activation requires that LISTEN_PID is set correctly
-	// it's tough to know beforehand while cloning
-	if os.Getenv("FIX_LISTEN_PID") != "" {
-		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
-	}
-
 	var fds []net.Listener
 	if tlsConfig != nil {
 		fds, err = activation.TLSListeners(tlsConfig)
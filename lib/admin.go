@@ -0,0 +1,296 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type Admin struct {
+	Socket string `long:"socket" description:"Path of the admin unix socket"`
+	UIDs   []int  `long:"uid" description:"Additional uid allowed to use the admin socket"`
+}
+
+type AdminRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+type AdminResponse struct {
+	Error       string             `json:"error,omitempty"`
+	Connections []ConnectionStatus `json:"connections,omitempty"`
+	Conns       []ConnStats        `json:"conns,omitempty"`
+}
+
+type ConnectionStatus struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Mode        string `json:"mode"`
+	Listen      string `json:"listen"`
+	Client      string `json:"client"`
+	ListenNetNs string `json:"listen_netns,omitempty"`
+	ClientNetNs string `json:"client_netns,omitempty"`
+	Pids        []int  `json:"pids,omitempty"`
+	Active      int    `json:"active"`
+	Accepted    uint64 `json:"accepted"`
+	BytesIn     uint64 `json:"bytes_in"`
+	BytesOut    uint64 `json:"bytes_out"`
+
+	CGroups []CGroupUsage `json:"cgroups,omitempty"`
+}
+
+// Drainer is implemented by proxies that can stop accepting new
+// connections while letting the current ones finish. Forked children
+// are given timeout to finish their connections.
+type Drainer interface {
+	Drain(timeout time.Duration) error
+}
+
+// Restarter is implemented by proxies that can replace their forked
+// children while running.
+type Restarter interface {
+	Restart() error
+}
+
+// Rebinder is implemented by proxies that listen in a forked child
+// and can listen again when the namespace has changed.
+type Rebinder interface {
+	Rebind() error
+}
+
+// Reloader is implemented by proxies with forked children that read
+// TLS certificates themselves.
+type Reloader interface {
+	Reload() error
+}
+
+// Pider is implemented by proxies that fork children.
+type Pider interface {
+	Pids() []int
+}
+
+type AdminServer struct {
+	Admin       *Admin
+	Connections []*Connection
+	Upgrade     func() error
+
+	ln *net.UnixListener
+}
+
+func (a *AdminServer) Listen() (err error) {
+	if err = os.Remove(a.Admin.Socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("admin: remove %s: %v", a.Admin.Socket, err)
+	}
+
+	a.ln, err = net.ListenUnix("unix", &net.UnixAddr{Name: a.Admin.Socket, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("admin: listen: %v", err)
+	}
+	// MainFunc removes the socket, unless a new process took it over.
+	a.ln.SetUnlinkOnClose(false)
+
+	// Anyone may connect, allowed decides who may use it.
+	return os.Chmod(a.Admin.Socket, 0o666)
+}
+
+func (a *AdminServer) Close() error {
+	return a.ln.Close()
+}
+
+func (a *AdminServer) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		a.ln.Close()
+	}()
+
+	for {
+		conn, err := a.ln.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := a.allowed(conn); err != nil {
+				json.NewEncoder(conn).Encode(&AdminResponse{Error: err.Error()})
+				return
+			}
+			a.handle(conn)
+		}()
+	}
+}
+
+func (a *AdminServer) allowed(conn *net.UnixConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return fmt.Errorf("admin: SO_PEERCRED: %v", credErr)
+	}
+
+	if cred.Uid == 0 || int(cred.Uid) == os.Getuid() {
+		return nil
+	}
+	for _, uid := range a.Admin.UIDs {
+		if int(cred.Uid) == uid {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("admin: uid %d not allowed", cred.Uid)
+}
+
+func (a *AdminServer) handle(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		req := &AdminRequest{}
+		var resp *AdminResponse
+		if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+			resp = &AdminResponse{Error: fmt.Sprintf("invalid request: %v", err)}
+		} else {
+			resp = a.Do(req)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (a *AdminServer) Do(req *AdminRequest) *AdminResponse {
+	resp := &AdminResponse{}
+	var err error
+	switch req.Command {
+	case "ls":
+		for i, c := range a.Connections {
+			resp.Connections = append(resp.Connections, c.Status(i))
+		}
+	case "conns":
+		for _, c := range a.Connections {
+			resp.Conns = append(resp.Conns, c.tracker.Conns()...)
+		}
+	case "kill":
+		err = a.kill(req.Args)
+	case "drain":
+		err = a.each(req.Args, func(c *Connection) error {
+			d, ok := c.proxy.(Drainer)
+			if !ok {
+				return fmt.Errorf("%s: drain not supported by %s", c.Name, c.Mode)
+			}
+			go func() {
+				if err := d.Drain(c.DrainTimeout); err != nil {
+					fmt.Printf("Error: %s: drain: %v\n", c.Name, err)
+				}
+			}()
+			return nil
+		})
+	case "restart":
+		err = a.each(req.Args, func(c *Connection) error {
+			r, ok := c.proxy.(Restarter)
+			if !ok {
+				return fmt.Errorf("%s: restart not supported by %s", c.Name, c.Mode)
+			}
+			return r.Restart()
+		})
+	case "upgrade":
+		if a.Upgrade == nil {
+			err = fmt.Errorf("upgrade not supported")
+			break
+		}
+		err = a.Upgrade()
+	case "reload":
+		for _, c := range a.Connections {
+			if err = c.Listen.TLS.Reload(); err != nil {
+				break
+			}
+			if err = c.Client.TLS.Reload(); err != nil {
+				break
+			}
+			if r, ok := c.proxy.(Reloader); ok {
+				if err = r.Reload(); err != nil {
+					err = fmt.Errorf("%s: reload: %v", c.Name, err)
+					break
+				}
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown command: %q", req.Command)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+func (a *AdminServer) kill(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("kill: missing id")
+	}
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("kill: invalid id %q: %v", arg, err)
+		}
+		found := false
+		for _, c := range a.Connections {
+			if c.tracker.Kill(id) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("kill: no connection with id %d", id)
+		}
+	}
+	return nil
+}
+
+// each calls f for every connection matching a name or index in args.
+func (a *AdminServer) each(args []string, f func(*Connection) error) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing connection name")
+	}
+	for _, arg := range args {
+		c := a.lookup(arg)
+		if c == nil {
+			return fmt.Errorf("no connection named %q", arg)
+		}
+		if err := f(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *AdminServer) lookup(name string) *Connection {
+	for _, c := range a.Connections {
+		if c.Name == name {
+			return c
+		}
+	}
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(a.Connections) {
+		return a.Connections[i]
+	}
+	return nil
+}
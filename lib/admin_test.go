@@ -0,0 +1,337 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func adminRequest(t *testing.T, path string, req *AdminRequest) *AdminResponse {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp := &AdminResponse{}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := json.Unmarshal(line, resp); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return resp
+}
+
+func TestAdminSocket(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer backend.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := &Connection{Mode: "Simple", proxy: &SimpleProxy{}}
+	if _, err := flags.ParseArgs(c, []string{
+		"--name=test",
+		fmt.Sprintf("--listen.addr=%s", addr),
+		fmt.Sprintf("--client.addr=%s", backend.Addr()),
+		"--client.netns.disable",
+	}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	c.Client.Ctx = ctx
+	c.tracker = NewTracker(c.Name)
+	c.Listen.conns = c.tracker
+
+	setup, setupDone := context.WithCancel(ctx)
+	c.proxy.(*SimpleProxy).SetupCtxCancel = setupDone
+	go c.proxy.Proxy(&c.Listen, &c.Client)
+	<-setup.Done()
+	defer c.proxy.Close()
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	admin := &AdminServer{Admin: &Admin{Socket: path}, Connections: []*Connection{c}}
+	if err := admin.Listen(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	go admin.Serve(ctx)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	upstream, err := backend.Accept()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer upstream.Close()
+
+	payload := "hello there"
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	buf := make([]byte, len(payload))
+	if _, err := upstream.Read(buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	resp := adminRequest(t, path, &AdminRequest{Command: "ls"})
+	if len(resp.Connections) != 1 || resp.Connections[0].Name != "test" || resp.Connections[0].Active != 1 {
+		t.Fatalf("unexpected ls response: %+v", resp)
+	}
+
+	resp = adminRequest(t, path, &AdminRequest{Command: "conns"})
+	if len(resp.Conns) != 1 {
+		t.Fatalf("unexpected conns response: %+v", resp)
+	}
+	if resp.Conns[0].BytesIn != uint64(len(payload)) {
+		t.Fatalf("bytes_in(%d) != len(payload)(%d)", resp.Conns[0].BytesIn, len(payload))
+	}
+
+	resp = adminRequest(t, path, &AdminRequest{Command: "kill", Args: []string{fmt.Sprint(resp.Conns[0].ID)}})
+	if resp.Error != "" {
+		t.Fatalf("%s", resp.Error)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatalf("connection not closed by kill")
+	}
+
+	resp = adminRequest(t, path, &AdminRequest{Command: "drain", Args: []string{"test"}})
+	if resp.Error != "" {
+		t.Fatalf("%s", resp.Error)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatalf("listener still accepting after drain")
+	}
+}
+
+func TestCtl(t *testing.T) {
+	c := &Connection{Mode: "Simple", proxy: &SimpleProxy{}}
+	if _, err := flags.ParseArgs(c, []string{
+		"--name=web",
+		"--listen.addr=127.0.0.1:8080",
+		"--client.addr=127.0.0.1:80",
+	}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	c.tracker = NewTracker(c.Name)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	admin := &AdminServer{Admin: &Admin{Socket: path}, Connections: []*Connection{c}}
+	if err := admin.Listen(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	go admin.Serve(ctx)
+
+	out := &bytes.Buffer{}
+	ctl := &Ctl{Socket: path, out: out}
+	if err := (&ctlLs{ctl}).Execute(nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.Contains(out.String(), "web") || !strings.Contains(out.String(), "127.0.0.1:8080") {
+		t.Fatalf("unexpected ls output: %s", out)
+	}
+
+	out.Reset()
+	ctl.JSON = true
+	if err := (&ctlStats{ctl: ctl}).Execute(nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	var stats []ConnectionStatus
+	if err := json.Unmarshal(out.Bytes(), &stats); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if len(stats) != 1 || stats[0].Name != "web" {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	kill := &ctlKill{ctl: ctl}
+	kill.Args.IDs = []string{"1234"}
+	if err := kill.Execute(nil); err == nil {
+		t.Fatalf("kill of unknown id did not fail")
+	}
+}
+
+func TestAdminSocketUID(t *testing.T) {
+	if os.Geteuid() != 0 {
+		allowed, denied := os.Getenv("GOPIPE_TEST_ADMIN_ALLOWED"), os.Getenv("GOPIPE_TEST_ADMIN_DENIED")
+		if allowed == "" {
+			t.Skip("needs root")
+		}
+		if resp := adminRequest(t, allowed, &AdminRequest{Command: "ls"}); resp.Error != "" {
+			t.Fatalf("%s", resp.Error)
+		}
+		// The refusal is sent before any request is read.
+		conn, err := net.Dial("unix", denied)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer conn.Close()
+		resp := &AdminResponse{}
+		if err := json.NewDecoder(conn).Decode(resp); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !strings.Contains(resp.Error, "not allowed") {
+			t.Fatalf("uid %d served without --admin.uid: %+v", os.Getuid(), resp)
+		}
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "gopipe")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, s := range []struct {
+		env  string
+		uids []int
+	}{
+		{"GOPIPE_TEST_ADMIN_ALLOWED", []int{65534}},
+		{"GOPIPE_TEST_ADMIN_DENIED", nil},
+	} {
+		path := filepath.Join(dir, strings.ToLower(s.env)+".sock")
+		admin := &AdminServer{Admin: &Admin{Socket: path, UIDs: s.uids}}
+		if err := admin.Listen(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer os.Remove(path)
+		go admin.Serve(ctx)
+		t.Setenv(s.env, path)
+	}
+
+	asNobody(t, "^TestAdminSocketUID$")
+}
+
+// TestReloadE2E replaces the certificates of a listening and a client
+// child, the backend sees the client certificate.
+func TestReloadE2E(t *testing.T) {
+	serverCert, serverKey, _ := writeCert(t, "localhost")
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	backend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				t := conn.(*tls.Conn)
+				if err := t.Handshake(); err != nil {
+					return
+				}
+				io.WriteString(conn, t.ConnectionState().PeerCertificates[0].Subject.CommonName)
+			}()
+		}
+	}()
+	listenCert, listenKey, _ := writeCert(t, "listen-a")
+	clientCert, clientKey, _ := writeCert(t, "client-a")
+	_, port, _ := net.SplitHostPort(backend.Addr().String())
+	addr, socket := freeAddr(t), filepath.Join(t.TempDir(), "admin.sock")
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestE2EBin$", "-test.timeout", "20s", "--",
+		"--admin.socket="+socket, "--listen.addr="+addr, "--listen.fork", "--client.fork",
+		"--listen.tls.cert-file="+listenCert, "--listen.tls.key-file="+listenKey,
+		"--client.addr="+net.JoinHostPort("localhost", port), "--client.tls.ca-file="+serverCert,
+		"--client.tls.cert-file="+clientCert, "--client.tls.key-file="+clientKey, "--drain-timeout=1s")
+	cmd.Env = []string{"CMD_TEST_E2E=1"}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Signal(os.Interrupt)
+
+	names := func() (string, string, error) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return "", "", err
+		}
+		defer conn.Close()
+		client, err := io.ReadAll(conn)
+		if err != nil {
+			return "", "", err
+		}
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, string(client), nil
+	}
+	want := func(listen, client string) {
+		var l, c string
+		var err error
+		for i := 0; i < 50; i++ {
+			if l, c, err = names(); err == nil && l == listen && c == client {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("got %q, %q, %v, want %q, %q", l, c, err, listen, client)
+	}
+	want("listen-a", "client-a")
+
+	for _, f := range []struct{ name, cert, key string }{
+		{"listen-b", listenCert, listenKey},
+		{"client-b", clientCert, clientKey},
+	} {
+		cert, key, _ := writeCert(t, f.name)
+		for src, dst := range map[string]string{cert: f.cert, key: f.key} {
+			data, err := os.ReadFile(src)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if err := os.WriteFile(dst, data, 0o600); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}
+	if resp := adminRequest(t, socket, &AdminRequest{Command: "reload"}); resp.Error != "" {
+		t.Fatalf("%s", resp.Error)
+	}
+	want("listen-b", "client-b")
+}
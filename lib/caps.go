@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/psx"
+)
+
+var capNames = map[string]uintptr{
+	"audit_control":      unix.CAP_AUDIT_CONTROL,
+	"audit_read":         unix.CAP_AUDIT_READ,
+	"audit_write":        unix.CAP_AUDIT_WRITE,
+	"block_suspend":      unix.CAP_BLOCK_SUSPEND,
+	"bpf":                unix.CAP_BPF,
+	"checkpoint_restore": unix.CAP_CHECKPOINT_RESTORE,
+	"chown":              unix.CAP_CHOWN,
+	"dac_override":       unix.CAP_DAC_OVERRIDE,
+	"dac_read_search":    unix.CAP_DAC_READ_SEARCH,
+	"fowner":             unix.CAP_FOWNER,
+	"fsetid":             unix.CAP_FSETID,
+	"ipc_lock":           unix.CAP_IPC_LOCK,
+	"ipc_owner":          unix.CAP_IPC_OWNER,
+	"kill":               unix.CAP_KILL,
+	"lease":              unix.CAP_LEASE,
+	"linux_immutable":    unix.CAP_LINUX_IMMUTABLE,
+	"mac_admin":          unix.CAP_MAC_ADMIN,
+	"mac_override":       unix.CAP_MAC_OVERRIDE,
+	"mknod":              unix.CAP_MKNOD,
+	"net_admin":          unix.CAP_NET_ADMIN,
+	"net_bind_service":   unix.CAP_NET_BIND_SERVICE,
+	"net_broadcast":      unix.CAP_NET_BROADCAST,
+	"net_raw":            unix.CAP_NET_RAW,
+	"perfmon":            unix.CAP_PERFMON,
+	"setfcap":            unix.CAP_SETFCAP,
+	"setgid":             unix.CAP_SETGID,
+	"setpcap":            unix.CAP_SETPCAP,
+	"setuid":             unix.CAP_SETUID,
+	"syslog":             unix.CAP_SYSLOG,
+	"sys_admin":          unix.CAP_SYS_ADMIN,
+	"sys_boot":           unix.CAP_SYS_BOOT,
+	"sys_chroot":         unix.CAP_SYS_CHROOT,
+	"sys_module":         unix.CAP_SYS_MODULE,
+	"sys_nice":           unix.CAP_SYS_NICE,
+	"sys_pacct":          unix.CAP_SYS_PACCT,
+	"sys_ptrace":         unix.CAP_SYS_PTRACE,
+	"sys_rawio":          unix.CAP_SYS_RAWIO,
+	"sys_resource":       unix.CAP_SYS_RESOURCE,
+	"sys_time":           unix.CAP_SYS_TIME,
+	"sys_tty_config":     unix.CAP_SYS_TTY_CONFIG,
+	"wake_alarm":         unix.CAP_WAKE_ALARM,
+}
+
+// parseCaps takes names like net_bind_service or CAP_NET_BIND_SERVICE.
+func parseCaps(names []string) ([]uintptr, error) {
+	caps := []uintptr{}
+	for _, name := range names {
+		c, ok := capNames[strings.TrimPrefix(strings.ToLower(name), "cap_")]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+func lastCap() uintptr {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	return uintptr(last)
+}
+
+// dropCaps keeps only the capabilities in keep, in the bounding set as
+// well so that they can't come back through an exec. Capabilities are
+// per thread, psx changes them on all threads of the process.
+func dropCaps(keep []uintptr) error {
+	var mask [2]uint32
+	for _, c := range keep {
+		mask[c/32] |= 1 << (c % 32)
+	}
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capget: %v", err)
+	}
+
+	// Without CAP_SETPCAP the bounding set can't be changed, but then
+	// there is nothing to lose either.
+	if data[0].Effective&(1<<unix.CAP_SETPCAP) != 0 {
+		for c := uintptr(0); c <= lastCap(); c++ {
+			if c < 64 && mask[c/32]&(1<<(c%32)) != 0 {
+				continue
+			}
+			if _, _, errno := psx.Syscall6(unix.SYS_PRCTL, unix.PR_CAPBSET_DROP, c, 0, 0, 0, 0); errno != 0 && errno != unix.EINVAL {
+				return fmt.Errorf("drop %d from bounding set: %v", c, errno)
+			}
+		}
+	}
+
+	for i := range data {
+		data[i].Effective &= mask[i]
+		data[i].Permitted &= mask[i]
+		data[i].Inheritable &= mask[i]
+	}
+	if _, _, errno := psx.Syscall3(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %v", errno)
+	}
+	return nil
+}
+
+// setNoNewPrivs keeps the process from gaining privileges through exec
+// of setuid binaries or files with capabilities.
+func setNoNewPrivs() error {
+	if _, _, errno := psx.Syscall6(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("no_new_privs: %v", errno)
+	}
+	return nil
+}
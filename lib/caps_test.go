@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseCaps(t *testing.T) {
+	caps, err := parseCaps([]string{"net_bind_service", "CAP_SETPCAP"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(caps) != 2 || caps[0] != unix.CAP_NET_BIND_SERVICE || caps[1] != unix.CAP_SETPCAP {
+		t.Errorf("unexpected %v", caps)
+	}
+	if _, err := parseCaps([]string{"net_bind"}); err == nil {
+		t.Errorf("unknown capability accepted")
+	}
+}
+
+func TestDropCaps(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+
+	// Dropping can't be undone, it's done in a copy of the test.
+	if os.Getenv("GOPIPE_TEST_DROP_CAPS") == "1" {
+		if err := dropCaps([]uintptr{unix.CAP_NET_BIND_SERVICE}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		data, err := os.ReadFile("/proc/self/status")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			for _, c := range []string{"CapPrm:", "CapEff:", "CapBnd:"} {
+				if strings.HasPrefix(line, c) && strings.TrimSpace(strings.TrimPrefix(line, c)) != "0000000000000400" {
+					t.Errorf("%s", line)
+				}
+			}
+		}
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropCaps$")
+	cmd.Env = append(os.Environ(), "GOPIPE_TEST_DROP_CAPS=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
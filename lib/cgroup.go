@@ -0,0 +1,355 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"golang.org/x/sys/unix"
+)
+
+// cgroupRoot returns where the hierarchy systemd uses for its units is
+// mounted, the unified one on v2 and hybrid setups.
+func cgroupRoot() string {
+	for _, p := range []string{"/sys/fs/cgroup/cgroup.controllers", "/sys/fs/cgroup/unified/cgroup.controllers"} {
+		if _, err := os.Stat(p); err == nil {
+			return filepath.Dir(p)
+		}
+	}
+	return "/sys/fs/cgroup/systemd"
+}
+
+func cgroupPath(p string) string {
+	if strings.HasPrefix(p, "/sys/fs/cgroup") {
+		return p
+	}
+	return filepath.Join(cgroupRoot(), p)
+}
+
+// cgroupPids returns the pids in the cgroup at dir and all cgroups below
+// it, sorted.
+func cgroupPids(dir string) ([]int, error) {
+	pids := []int{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != "cgroup.procs" {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			// Removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			pid, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+			if err != nil {
+				continue
+			}
+			pids = append(pids, pid)
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// cgroupPid picks a process in the cgroup at dir. keep is picked as long
+// as it's still in there, otherwise the lowest pid is, so that the same
+// process is picked every time.
+func cgroupPid(dir string, keep int) (int, error) {
+	pids, err := cgroupPids(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(pids) == 0 {
+		return 0, fmt.Errorf("no processes in %s", dir)
+	}
+	for _, pid := range pids {
+		if pid == keep {
+			return keep, nil
+		}
+	}
+	return pids[0], nil
+}
+
+// getCGroupPid finds a process in CGroup or in the cgroup of SystemdScope.
+func (n *NetworkNamespace) getCGroupPid(keep int) (int, error) {
+	dir := n.CGroup
+	if n.SystemdScope != "" {
+		cg, err := n.getSystemdControlGroup(n.SystemdScope)
+		if err != nil {
+			return 0, err
+		}
+		dir = cg
+	}
+	return cgroupPid(cgroupPath(dir), keep)
+}
+
+func (n *NetworkNamespace) getSystemdControlGroup(unit string) (string, error) {
+	var unitType string
+	switch filepath.Ext(unit) {
+	case ".scope":
+		unitType = "Scope"
+	case ".slice":
+		unitType = "Slice"
+	case ".service":
+		unitType = "Service"
+	default:
+		return "", fmt.Errorf("%s is not a scope, slice or service", unit)
+	}
+
+	conn, err := dbus.NewWithContext(n.Ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	prop, err := conn.GetUnitTypePropertyContext(n.Ctx, unit, unitType, "ControlGroup")
+	if err != nil {
+		return "", err
+	}
+
+	cg, ok := prop.Value.Value().(string)
+	if !ok || cg == "" {
+		return "", fmt.Errorf("%s has no control group", unit)
+	}
+	return cg, nil
+}
+
+// cgroupLeaf is where gopipe moves itself before it gives its children
+// cgroups of their own, a cgroup with controllers enabled for its
+// children can't have processes.
+const cgroupLeaf = "gopipe"
+
+// cgroupControllers are enabled for the cgroups of children, when
+// they are delegated to gopipe.
+var cgroupControllers = []string{"cpu", "memory", "pids"}
+
+var childCGroups struct {
+	sync.Mutex
+	parent string
+	n      int
+}
+
+// cgroupOf returns the cgroup v2 directory of pid.
+func cgroupOf(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			return cgroupPath(p), nil
+		}
+	}
+	return "", fmt.Errorf("process %d is in no cgroup v2", pid)
+}
+
+// childCGroupParent returns the cgroup children get cgroups in, the one
+// gopipe was started in. With systemd it's delegated with Delegate=yes.
+// gopipe moves itself to a leaf below it, which it then stays in.
+func childCGroupParent() (string, error) {
+	childCGroups.Lock()
+	defer childCGroups.Unlock()
+	if childCGroups.parent != "" {
+		return childCGroups.parent, nil
+	}
+
+	self, err := cgroupOf(os.Getpid())
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(self, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("cgroup v2 is needed: %v", err)
+	}
+	parent := self
+	if filepath.Base(self) == cgroupLeaf {
+		// Started by an upgrade, the cgroups are set up already.
+		parent = filepath.Dir(self)
+	} else if self != cgroupRoot() {
+		leaf := filepath.Join(self, cgroupLeaf)
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		if err := writeCGroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			return "", fmt.Errorf("move to %s: %v", leaf, err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	available := strings.Fields(string(data))
+	enable := []string{}
+	for _, c := range cgroupControllers {
+		for _, a := range available {
+			if a == c {
+				enable = append(enable, "+"+c)
+			}
+		}
+	}
+	if len(enable) > 0 {
+		if err := writeCGroupFile(parent, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+			// Only gopipe is moved to the leaf, others keep parent busy.
+			if errors.Is(err, unix.EBUSY) {
+				return "", fmt.Errorf("enable %s in %s: other processes are in it, gopipe needs a cgroup of its own, like a unit with Delegate=yes", strings.Join(enable, " "), parent)
+			}
+			return "", fmt.Errorf("enable %s in %s: %v", strings.Join(enable, " "), parent, err)
+		}
+	}
+
+	childCGroups.parent = parent
+	return parent, nil
+}
+
+// writeCGroupFile writes to a file of the cgroup at dir, files of
+// controllers that aren't enabled don't exist.
+func writeCGroupFile(dir, file, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(value); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// cpuMax takes cpu.max as the kernel does, quota and period in µs, or
+// a percentage of one CPU.
+func cpuMax(s string) (string, error) {
+	p, ok := strings.CutSuffix(s, "%")
+	if !ok {
+		return s, nil
+	}
+	f, err := strconv.ParseFloat(p, 64)
+	if err != nil || f <= 0 {
+		return "", fmt.Errorf("cpu max %q is not a percentage", s)
+	}
+	return fmt.Sprintf("%d 100000", int(f*1000)), nil
+}
+
+// newChildCGroup creates a cgroup for a child with limits, files like
+// memory.max and what to write to them. The returned fd is for
+// CLONE_INTO_CGROUP.
+func newChildCGroup(limits map[string]string) (int, error) {
+	parent, err := childCGroupParent()
+	if err != nil {
+		return -1, err
+	}
+	childCGroups.Lock()
+	childCGroups.n++
+	dir := filepath.Join(parent, fmt.Sprintf("child-%d-%d", os.Getpid(), childCGroups.n))
+	childCGroups.Unlock()
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return -1, err
+	}
+	for file, value := range limits {
+		if err := writeCGroupFile(dir, file, value); err != nil {
+			os.Remove(dir)
+			if errors.Is(err, fs.ErrNotExist) {
+				return -1, fmt.Errorf("%s: controller is not delegated to %s", file, parent)
+			}
+			return -1, fmt.Errorf("%s %q: %v", file, value, err)
+		}
+	}
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		os.Remove(dir)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// removeCGroup removes the cgroup of a child that has exited. Processes
+// left in a pid namespace are killed with it, but it may take a moment.
+func removeCGroup(dir string) {
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Printf("Warning: remove cgroup %s: %v\n", dir, err)
+}
+
+// CGroupUsage is what a forked child uses, from its cgroup.
+type CGroupUsage struct {
+	Pid           int    `json:"pid"`
+	CGroup        string `json:"cgroup"`
+	MemoryCurrent uint64 `json:"memory_current"`
+	MemoryPeak    uint64 `json:"memory_peak,omitempty"`
+	Pids          uint64 `json:"pids"`
+	CPUUsec       uint64 `json:"cpu_usec"`
+	OOMKills      uint64 `json:"oom_kills,omitempty"`
+}
+
+// readCGroupUsage reads the usage of the cgroup at dir, what a
+// controller that isn't enabled would tell is left out.
+func readCGroupUsage(dir string) CGroupUsage {
+	u := CGroupUsage{CGroup: dir}
+	value := func(file string) uint64 {
+		data, _ := os.ReadFile(filepath.Join(dir, file))
+		n, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		return n
+	}
+	key := func(file, name string) uint64 {
+		data, _ := os.ReadFile(filepath.Join(dir, file))
+		for _, line := range strings.Split(string(data), "\n") {
+			if f := strings.Fields(line); len(f) == 2 && f[0] == name {
+				n, _ := strconv.ParseUint(f[1], 10, 64)
+				return n
+			}
+		}
+		return 0
+	}
+	u.MemoryCurrent, u.MemoryPeak = value("memory.current"), value("memory.peak")
+	u.Pids = value("pids.current")
+	u.CPUUsec = key("cpu.stat", "usage_usec")
+	u.OOMKills = key("memory.events", "oom_kill")
+	return u
+}
+
+// childCGroupUsage returns the usage of the cgroup of pid, if it's one
+// gopipe created for it.
+func childCGroupUsage(pid int) (CGroupUsage, bool) {
+	childCGroups.Lock()
+	parent := childCGroups.parent
+	childCGroups.Unlock()
+	if parent == "" {
+		return CGroupUsage{}, false
+	}
+	dir, err := cgroupOf(pid)
+	if err != nil || filepath.Dir(dir) != parent {
+		return CGroupUsage{}, false
+	}
+	u := readCGroupUsage(dir)
+	u.Pid = pid
+	return u, true
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCGroupPid(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "app.scope", "sub"), 0o755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for path, procs := range map[string]string{
+		"cgroup.procs":               "",
+		"app.scope/cgroup.procs":     "300\n200\n",
+		"app.scope/sub/cgroup.procs": "150\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(procs), 0o644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	if pid, err := cgroupPid(dir, 0); err != nil || pid != 150 {
+		t.Fatalf("pid(%d) != 150: %v", pid, err)
+	}
+	if pid, err := cgroupPid(dir, 300); err != nil || pid != 300 {
+		t.Fatalf("pid(%d) != 300: %v", pid, err)
+	}
+	if pid, err := cgroupPid(dir, 400); err != nil || pid != 150 {
+		t.Fatalf("pid(%d) != 150: %v", pid, err)
+	}
+	if _, err := cgroupPid(filepath.Join(dir, "app.scope", "sub", "empty"), 0); err == nil {
+		t.Fatalf("found a pid in a missing cgroup")
+	}
+}
+
+func TestReadCGroupUsage(t *testing.T) {
+	dir := t.TempDir()
+	for file, data := range map[string]string{
+		"memory.current": "1048576\n",
+		"pids.current":   "7\n",
+		"cpu.stat":       "usage_usec 2500\nuser_usec 2000\nsystem_usec 500\n",
+		"memory.events":  "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0o644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	u := readCGroupUsage(dir)
+	want := CGroupUsage{CGroup: dir, MemoryCurrent: 1048576, Pids: 7, CPUUsec: 2500, OOMKills: 1}
+	if u != want {
+		t.Errorf("%+v != %+v", u, want)
+	}
+}
+
+func TestCPUMax(t *testing.T) {
+	for in, want := range map[string]string{"50%": "50000 100000", "150%": "150000 100000", "20000 50000": "20000 50000", "max": "max"} {
+		if got, err := cpuMax(in); err != nil || got != want {
+			t.Errorf("%s: %q != %q: %v", in, got, want, err)
+		}
+	}
+	if _, err := cpuMax("x%"); err == nil {
+		t.Errorf("x%% accepted")
+	}
+}
+
+func TestForkChildCGroupRelease(t *testing.T) {
+	dir := t.TempDir()
+	childCGroups.Lock()
+	childCGroups.parent = dir
+	childCGroups.Unlock()
+	defer func() {
+		childCGroups.Lock()
+		childCGroups.parent = ""
+		childCGroups.Unlock()
+	}()
+
+	// Without nsenter it fails to start after Prepare made the cgroup.
+	t.Setenv("PATH", "")
+	netns := &NetworkNamespace{MountNS: true, Ctx: context.Background()}
+	proc := &Proc{Sandbox: "none", CGroup: true}
+	if _, _, err := ForkChild(context.Background(), proc, &User{}, netns, &ChildConfig{}, nil); err == nil {
+		t.Fatalf("child started")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(entries) > 0 {
+		t.Fatalf("cgroup %s left", entries[0].Name())
+	}
+}
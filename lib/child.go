@@ -0,0 +1,281 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// childConfigVersion is bumped when a child built from older code
+// can't make sense of ChildConfig anymore, e.g. after the binary was
+// replaced on disk.
+const childConfigVersion = 1
+
+// childArgs come before --child, tests use them to run the test binary
+// as gopipe.
+var childArgs []string
+
+// childReadyTimeout is how long a forked child gets to set itself up.
+var childReadyTimeout = 10 * time.Second
+
+// ChildSandbox is what a forked child does to itself once it has loaded
+// its certificates, Prepare works it out from the options of its side.
+type ChildSandbox struct {
+	Seccomp        string   `json:"seccomp,omitempty"`
+	SeccompProfile string   `json:"seccomp_profile,omitempty"`
+	Landlock       bool     `json:"landlock,omitempty"`
+	DropCaps       bool     `json:"drop_caps,omitempty"`
+	Caps           []string `json:"caps,omitempty"`
+	NoNewPrivs     bool     `json:"no_new_privs,omitempty"`
+	PrivateRoot    bool     `json:"private_root,omitempty"`
+	Chroot         string   `json:"chroot,omitempty"`
+}
+
+// ChildConfig is sent by the parent as the first message to a forked
+// child. Listen and Client are the options of the parent, the child
+// takes the role it's given on top of them.
+type ChildConfig struct {
+	Version int `json:"version"`
+	// Role is listen for a child that accepts and passes connections
+	// on, client for one that is passed connections and dials.
+	Role         string        `json:"role"`
+	Listen       *Listen       `json:"listen"`
+	Client       *Client       `json:"client"`
+	Sandbox      ChildSandbox  `json:"sandbox"`
+	DrainTimeout time.Duration `json:"drain_timeout"`
+	// Conn is the fd connections are passed over, the channel to the
+	// parent unless it's the one of another child.
+	Conn         int  `json:"conn"`
+	ReportActive bool `json:"report_active,omitempty"`
+}
+
+// ChildReply is sent back once the child is set up, or with the stage
+// it failed at.
+type ChildReply struct {
+	Version int    `json:"version"`
+	Stage   string `json:"stage,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (r *ChildReply) Err() error {
+	if r.Version != childConfigVersion {
+		return fmt.Errorf("reply version %d, expected %d", r.Version, childConfigVersion)
+	}
+	if r.Error != "" {
+		return fmt.Errorf("%s: %s", r.Stage, r.Error)
+	}
+	return nil
+}
+
+// ForkChild starts gopipe as a forked child with a unix channel to it
+// as fd 3 and files after it, and configures it with cfg. listener is
+// handed over together with the config. It returns once the child is
+// set up, a child that fails or doesn't answer in time is killed.
+func ForkChild(ctx context.Context, proc *Proc, user *User, netns *NetworkNamespace, cfg *ChildConfig, listener *os.File, files ...*os.File) (*Child, *net.UnixConn, error) {
+	args := append(append([]string{}, childArgs...), "--child=3")
+	cmd := exec.CommandContext(ctx, os.Args[0], args...)
+
+	child, err := proc.Prepare(cmd, user, netns)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Removes the cgroup if we fail before StartChild took it over.
+	defer releaseCGroup(cmd)
+	cfg.Sandbox = child.childSandbox()
+	if cfg.Conn == 0 {
+		cfg.Conn = 3
+	}
+
+	conns, err := UnixPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	uc, ok := conns[0].(*net.UnixConn)
+	if !ok {
+		return nil, nil, fmt.Errorf("unable to convert conn to unixconn")
+	}
+
+	fc, _ := conns[1].(*net.UnixConn).File()
+	cmd.ExtraFiles, cmd.Stdout, cmd.Stderr = append([]*os.File{fc}, files...), os.Stdout, os.Stderr
+
+	c, err := netns.Start(cmd, cfg.DrainTimeout)
+	// The child has its own copy now, closing ours lets reads on uc
+	// see EOF when the child exits.
+	fc.Close()
+	conns[1].Close()
+	if err != nil {
+		uc.Close()
+		return nil, nil, err
+	}
+
+	if err := configureChild(c, uc, cfg, listener); err != nil {
+		uc.Close()
+		return nil, nil, err
+	}
+	return c, uc, nil
+}
+
+// configureChild sends cfg and listener to child over uc and waits for
+// it to reply.
+func configureChild(child *Child, uc *net.UnixConn, cfg *ChildConfig, listener *os.File) error {
+	cfg.Version = childConfigVersion
+	payload, err := json.Marshal(cfg)
+	if err != nil {
+		child.Process.Kill()
+		child.Wait()
+		return fmt.Errorf("child config: %v", err)
+	}
+
+	viaf, err := uc.File()
+	if err != nil {
+		child.Process.Kill()
+		child.Wait()
+		return fmt.Errorf("file: %v", err)
+	}
+	defer viaf.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		fd := int(viaf.Fd())
+		if err := WriteMsg(fd, &Msg{Type: MsgConfig, Payload: payload, File: listener}); err != nil {
+			errCh <- err
+			return
+		}
+		m, err := ReadMsg(fd, "reply")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if m.File != nil {
+			m.File.Close()
+		}
+		if m.Type != MsgConfigReply {
+			errCh <- fmt.Errorf("expected config reply, got message %d", m.Type)
+			return
+		}
+		reply := &ChildReply{}
+		if err := json.Unmarshal(m.Payload, reply); err != nil {
+			errCh <- fmt.Errorf("config reply: %v", err)
+			return
+		}
+		errCh <- reply.Err()
+	}()
+
+	select {
+	case err = <-errCh:
+	case <-time.After(childReadyTimeout):
+		err = fmt.Errorf("not ready after %s", childReadyTimeout)
+	}
+	if err == nil {
+		return nil
+	}
+	child.Process.Kill()
+	if werr := child.Wait(); err == io.EOF && werr != nil {
+		err = fmt.Errorf("exited before it was set up: %v", exitError(werr))
+	}
+	return fmt.Errorf("child %d: %v", child.Pid(), err)
+}
+
+// readChildConfig makes c the forked child the parent sends the config
+// of on c.Child.
+func (c *Connection) readChildConfig() error {
+	m, err := ReadMsg(c.Child, "listener")
+	if err != nil {
+		return err
+	}
+	if m.Type != MsgConfig {
+		if m.File != nil {
+			m.File.Close()
+		}
+		return fmt.Errorf("expected config, got message %d", m.Type)
+	}
+
+	// Tell the version apart first, the rest may not fit.
+	version := struct {
+		Version int `json:"version"`
+	}{}
+	if err := json.Unmarshal(m.Payload, &version); err != nil {
+		return err
+	}
+	if version.Version != childConfigVersion {
+		return fmt.Errorf("config version %d, expected %d", version.Version, childConfigVersion)
+	}
+	cfg := &ChildConfig{Listen: &c.Listen, Client: &c.Client}
+	if err := json.Unmarshal(m.Payload, cfg); err != nil {
+		return err
+	}
+
+	c.ChildSandbox, c.DrainTimeout = cfg.Sandbox, cfg.DrainTimeout
+	// We were started in the namespaces already.
+	c.Listen.NetNs.Disable, c.Client.NetNs.Disable = true, true
+	conn := &Addr{Addr: fmt.Sprintf("FD:%d", cfg.Conn)}
+	switch cfg.Role {
+	case "listen":
+		c.Client.Addr = conn
+		c.Listen.inherited = m.File
+		if cfg.Conn != c.Child {
+			c.Listen.control = c.Child
+		}
+	case "client":
+		c.Listen.Addr = conn
+		c.Listen.IncomingConn, c.Listen.ReportActive = true, cfg.ReportActive
+	default:
+		return fmt.Errorf("unknown role %q", cfg.Role)
+	}
+	if m.File != nil && c.Listen.inherited == nil {
+		m.File.Close()
+	}
+	return nil
+}
+
+// childReady tells the parent of a forked child that it's set up, or
+// at what stage it failed if err is set.
+func (c *Connection) childReady(stage string, err error) error {
+	reply := &ChildReply{Version: childConfigVersion}
+	if err != nil {
+		reply.Stage, reply.Error = stage, err.Error()
+	}
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	if err := WriteMsg(c.Child, &Msg{Type: MsgConfigReply, Payload: payload}); err != nil {
+		return err
+	}
+	// The channel was only for the config if connections come over
+	// another one, unless the parent still asks for the listener.
+	if reply.Error == "" && c.Child != c.connFd() && c.Child != c.Listen.control {
+		return unix.Close(c.Child)
+	}
+	return nil
+}
+
+// connFd is the fd a forked child is passed connections on, or passes
+// them on.
+func (c *Connection) connFd() int {
+	if c.Listen.IncomingConn {
+		fd, _ := c.Listen.Fd()
+		return fd
+	}
+	fd, _ := c.Client.Fd()
+	return fd
+}
+
+// fail stops a forked child that couldn't be set up, the parent is told
+// at what stage. Outside of a forked child it panics.
+func (c *Connection) fail(stage string, err error) {
+	if c.Child == 0 {
+		panic(err)
+	}
+	if rerr := c.childReady(stage, err); rerr != nil {
+		fmt.Printf("Error: %s: %v\n", stage, err)
+	}
+	os.Exit(1)
+}
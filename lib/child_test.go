@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChildConfig(t *testing.T) {
+	pipe := &Pipe{}
+	if _, err := pipe.Unixpair(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	l := &Listen{Addr: &Addr{Addr: "127.0.0.1:8080"}, User: &User{User: "nobody"}, Proc: &Proc{ShouldFork: true}, Protocol: "tcp"}
+	c := &Client{Addr: &Addr{Addr: "127.0.0.1:9090"}, User: &User{}, Proc: &Proc{}, Protocol: "tcp",
+		SourceIP: "127.0.0.2", Timeout: 3 * time.Second, TLS: ClientTLS{CAFiles: []string{"ca.pem"}}}
+	cfg := &ChildConfig{Version: childConfigVersion, Role: "client", Listen: l, Client: c,
+		Sandbox: ChildSandbox{Landlock: true}, DrainTimeout: time.Minute, Conn: 4, ReportActive: true}
+	payload, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := WriteMsg(pipe.Fds[0], &Msg{Type: MsgConfig, Payload: payload}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	k := &Connection{Child: pipe.Fds[1]}
+	if err := k.readChildConfig(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if k.Client.SourceIP != "127.0.0.2" || k.Client.Timeout != 3*time.Second || k.Client.GetAddr() != "127.0.0.1:9090" {
+		t.Errorf("client options lost: %s %s %s", k.Client.SourceIP, k.Client.Timeout, k.Client.GetAddr())
+	}
+	if len(k.Client.TLS.CAFiles) != 1 || k.Listen.User.User != "nobody" {
+		t.Errorf("tls or user lost: %v %+v", k.Client.TLS.CAFiles, k.Listen.User)
+	}
+	if k.Listen.GetAddr() != "FD:4" || !k.Listen.IncomingConn || !k.Listen.ReportActive {
+		t.Errorf("not configured as a client child: %s %t %t", k.Listen.GetAddr(), k.Listen.IncomingConn, k.Listen.ReportActive)
+	}
+	if k.Listen.Proc != nil || !k.Listen.NetNs.Disable {
+		t.Errorf("fork options or namespace reached the child")
+	}
+	if !k.Landlock || k.DrainTimeout != time.Minute {
+		t.Errorf("sandbox or drain timeout lost: %+v %s", k.ChildSandbox, k.DrainTimeout)
+	}
+
+	if err := k.childReady("landlock", errors.New("denied")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	m, err := ReadMsg(pipe.Fds[0], "reply")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	reply := &ChildReply{}
+	if err := json.Unmarshal(m.Payload, reply); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := reply.Err(); err == nil || err.Error() != "landlock: denied" {
+		t.Errorf("reply %v", err)
+	}
+
+	// A child of another version refuses the config.
+	payload, _ = json.Marshal(&ChildConfig{Version: childConfigVersion + 1, Role: "client"})
+	if err := WriteMsg(pipe.Fds[0], &Msg{Type: MsgConfig, Payload: payload}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := (&Connection{Child: pipe.Fds[1]}).readChildConfig(); err == nil {
+		t.Errorf("config of another version accepted")
+	}
+}
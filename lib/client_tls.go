@@ -5,10 +5,12 @@ import (
 	"crypto/x509"
 	"fmt"
 	"os"
+	"sync/atomic"
 )
 
 type ClientTLS struct {
 	config *tls.Config
+	cert   atomic.Pointer[tls.Certificate]
 
 	CAFiles  []string `long:"ca-file" description:"TLS CA file"`
 	CertFile string   `long:"cert-file" description:"TLS Cert file"`
@@ -16,23 +18,6 @@ type ClientTLS struct {
 	Debug    bool     `long:"debug"`
 }
 
-func (c *ClientTLS) Args(group string) (args []string) {
-	if c.CertFile != "" {
-		args = append(args, fmt.Sprintf("--%s.cert-file=%s", group, c.CertFile))
-	}
-	if c.KeyFile != "" {
-		args = append(args, fmt.Sprintf("--%s.key-file=%s", group, c.KeyFile))
-	}
-	if c.Debug {
-		args = append(args, fmt.Sprintf("--%s.debug", group))
-	}
-	for _, k := range c.CAFiles {
-		args = append(args, fmt.Sprintf("--%s.ca-file=%s", group, k))
-	}
-
-	return
-}
-
 func (c *ClientTLS) TLSConfig() error {
 	return c.tlsConfig(true)
 }
@@ -68,14 +53,34 @@ func (c *ClientTLS) tlsConfig(client bool) error {
 	}
 
 	if c.CertFile != "" && c.KeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
-		if err != nil {
-			return fmt.Errorf(
-				"could not load keypair %s:%s: %v", c.CertFile, c.KeyFile, err)
+		if err := c.Reload(); err != nil {
+			return err
+		}
+
+		// Certificates are looked up per handshake so Reload can replace them.
+		c.config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.cert.Load(), nil
 		}
+		c.config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.cert.Load(), nil
+		}
+	}
+
+	return nil
+}
+
+// Reload reads the key pair again, new handshakes use the new certificate.
+func (c *ClientTLS) Reload() error {
+	if c == nil || c.CertFile == "" || c.KeyFile == "" {
+		return nil
+	}
 
-		c.config.Certificates = []tls.Certificate{cert}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return fmt.Errorf(
+			"could not load keypair %s:%s: %v", c.CertFile, c.KeyFile, err)
 	}
 
+	c.cert.Store(&cert)
 	return nil
 }
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"fmt"
+	"strings"
 	"syscall"
 )
 
@@ -73,6 +74,7 @@ func NewCloneflags() (*Cloneflags, error) {
 			// and CAP_SETGID.  Starting with Linux 3.8, no privileges
 			// are needed to create a user namespace.
 			"NEWUSER_NOCAPS": {3, 8, 0},
+			"NEWTIME":        {5, 6, 0},
 			"NEWUTS":         {2, 6, 19},
 			// The CLONE_PARENT flag can't be used in clone calls by the
 			// global init process (PID 1 in the initial PID namespace)
@@ -120,7 +122,7 @@ func NewCloneflags() (*Cloneflags, error) {
 		flagsRequired: map[string][]string{
 			"CHILD_SETTID": {"VM"},
 			"SIGHAND":      {"VM"},
-			"THEARD":       {"SIGHAND", "VM"},
+			"THREAD":       {"SIGHAND", "VM"},
 		},
 		configRequired: map[string][]string{
 			"IO": {"BLOCK"},
@@ -145,7 +147,7 @@ func (c *Cloneflags) requiresCloneflagsSet(name string) bool {
 		return true
 	}
 
-	ok = false
+	ok = true
 	for _, flag := range flags {
 		switch flag {
 		case "VM":
@@ -180,35 +182,35 @@ func (c *Cloneflags) requiresCloneflagsUnset(name string) bool {
 				c.Errors = append(c.Errors,
 					fmt.Errorf("clone flag %s conflicts ShareFSInfo", name))
 			}
-			ok = ok && c.ShareFSInfo
+			ok = ok && !c.ShareFSInfo
 		case "SYSVSEM":
 			if c.SetSystemV {
 				c.Errors = append(c.Errors,
-					fmt.Errorf("clone flag %s requires SetSystemV", name))
+					fmt.Errorf("clone flag %s conflicts SetSystemV", name))
 			}
-			ok = ok && c.SetSystemV
+			ok = ok && !c.SetSystemV
 		case "THREAD":
 			if c.SetThread {
 				c.Errors = append(c.Errors,
 					fmt.Errorf("clone flag %s conflicts SetThread", name))
 			}
-			ok = ok && c.SetThread
+			ok = ok && !c.SetThread
 		case "PARENT":
 			if c.SetPPID {
 				c.Errors = append(c.Errors,
 					fmt.Errorf("clone flag %s conflicts SetPPID", name))
 			}
-			ok = ok && c.SetPPID
+			ok = ok && !c.SetPPID
 		case "SIGHAND":
 			if c.ProtectSignals {
 				c.Errors = append(c.Errors,
 					fmt.Errorf("clone flag %s conflicts ProtectSignals", name))
 			}
-			ok = ok && c.ProtectSignals
+			ok = ok && !c.ProtectSignals
 		}
 	}
 
-	return !ok
+	return ok
 }
 
 func (c *Cloneflags) requires(name string) bool {
@@ -284,7 +286,7 @@ func (c *Cloneflags) Set() *syscall.SysProcAttr {
 
 	// CLONE_DETACHED = 0x00400000 // Unused, ignored
 
-	if c.DisablePTRACE {
+	if c.DisablePTRACE && c.requires("UNTRACED") {
 		// CLONE_UNTRACED = 0x00800000 // set if the tracing process can't force CLONE_PTRACE on this clone
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_UNTRACED
 	}
@@ -299,55 +301,138 @@ func (c *Cloneflags) Set() *syscall.SysProcAttr {
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_SETTLS
 	}
 
-	if c.PrivateCGroup {
+	if c.PrivateCGroup && c.requires("NEWCGROUP") {
 		// CLONE_NEWCGROUP = 0x02000000 // New cgroup namespace
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWCGROUP
 	}
 
-	if c.PrivateUTS {
+	if c.PrivateUTS && c.requires("NEWUTS") {
 		// CLONE_NEWUTS = 0x04000000 // New utsname namespace
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUTS
 	}
 
-	if c.PrivateIPC {
+	if c.PrivateIPC && c.requires("NEWIPC") {
 		// CLONE_NEWIPC = 0x08000000 // New ipc namespace
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWIPC
 	}
 
-	if c.PrivateUsers {
+	if c.PrivateUsers && c.requires("NEWUSER") {
 		// CLONE_NEWUSER = 0x10000000 // New user namespace
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
 	}
 
-	if c.PrivatePID {
+	if c.PrivatePID && c.requires("NEWPID") {
 		// CLONE_NEWPID = 0x20000000 // New pid namespace
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWPID
 	}
 
-	if c.PrivateNetwork {
+	if c.PrivateNetwork && c.requires("NEWNET") {
 		// CLONE_NEWNET = 0x40000000 // New network namespace
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
 	}
 
-	if c.PrivateIO {
+	if c.PrivateIO && c.requires("IO") {
 		// CLONE_IO = 0x80000000 // Clone io context
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_IO
 	}
 
-	if c.ResetSignals {
+	if c.ResetSignals && c.requires("CLEAR_SIGHAND") {
 		// CLONE_CLEAR_SIGHAND = 0x100000000 // Clear any signal handler and reset to SIG_DFL.
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_CLEAR_SIGHAND
 	}
 
-	if c.JoinCGroup {
+	if c.JoinCGroup && c.requires("INTO_CGROUP") {
 		// CLONE_INTO_CGROUP = 0x200000000 // Clone into a specific cgroup given the right permissions.
-		c.SysProcAttr.Cloneflags |= syscall.CLONE_INTO_CGROUP
+		// Only clone3 has it, Go uses that and sets the flag when
+		// asked to use CgroupFD, which the caller sets.
+		c.SysProcAttr.UseCgroupFD = true
 	}
 
-	if c.PrivateClock {
+	if c.PrivateClock && c.requires("NEWTIME") {
 		// CLONE_NEWTIME = 0x00000080 // New time namespace
 		c.SysProcAttr.Cloneflags |= syscall.CLONE_NEWTIME
 	}
 
 	return c.SysProcAttr
 }
+
+// sandbox returns the namespace flag behind a name used by the
+// --*.sandbox.enable and --*.sandbox.disable options.
+func (c *Cloneflags) sandbox(name string) *bool {
+	switch name {
+	case "cgroup":
+		return &c.PrivateCGroup
+	case "clock":
+		return &c.PrivateClock
+	case "io":
+		return &c.PrivateIO
+	case "ipc":
+		return &c.PrivateIPC
+	case "mounts":
+		return &c.PrivateMounts
+	case "pid":
+		return &c.PrivatePID
+	case "users":
+		return &c.PrivateUsers
+	case "uts":
+		return &c.PrivateUTS
+	case "untraced":
+		return &c.DisablePTRACE
+	}
+	return nil
+}
+
+// Profile sets the flags of a sandbox profile. By default the user
+// namespace is only private when the child keeps running as root,
+// strict always makes it private.
+func (c *Cloneflags) Profile(name string, root bool) error {
+	switch name {
+	case "none":
+		return nil
+	case "", "default", "strict":
+	default:
+		return fmt.Errorf("unknown sandbox profile %q", name)
+	}
+
+	c.PrivateMounts = true
+	c.PrivatePID = true
+	c.PrivateUsers = root || name == "strict"
+	c.PrivateUTS = true
+	// hangs child process
+	// c.PrivateTLS = true
+	c.PrivateIO = true
+	c.PrivateIPC = true
+	c.PrivateClock = true
+	c.PrivateCGroup = true
+	c.DisablePTRACE = name == "strict"
+	return nil
+}
+
+// Override turns the named flags on or off after the profile.
+func (c *Cloneflags) Override(enable, disable []string) error {
+	for _, names := range []struct {
+		names []string
+		v     bool
+	}{{enable, true}, {disable, false}} {
+		for _, name := range names.names {
+			flag := c.sandbox(name)
+			if flag == nil {
+				return fmt.Errorf("unknown sandbox flag %q", name)
+			}
+			*flag = names.v
+		}
+	}
+	return nil
+}
+
+// Err returns what Set found wrong with the flags.
+func (c *Cloneflags) Err() error {
+	if len(c.Errors) == 0 {
+		return nil
+	}
+	errs := make([]string, 0, len(c.Errors))
+	for _, err := range c.Errors {
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("sandbox: %s", strings.Join(errs, ", "))
+}
@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestKernelVersionOk(t *testing.T) {
+	required := KernelVersion{5, 6, 0}
+	for _, v := range []struct {
+		version KernelVersion
+		ok      bool
+	}{
+		{KernelVersion{6, 1, 0}, true},
+		{KernelVersion{5, 6, 0}, true},
+		{KernelVersion{5, 10, 0}, true},
+		{KernelVersion{5, 5, 19}, false},
+		{KernelVersion{4, 19, 0}, false},
+	} {
+		if ok := required.Ok(v.version); ok != v.ok {
+			t.Errorf("%v at least %v: %t, expected %t", v.version, required, ok, v.ok)
+		}
+	}
+}
+
+func TestProcPrepare(t *testing.T) {
+	cmd := exec.Command("true")
+	p := &Proc{Sandbox: "default", SandboxDisable: []string{"clock"}}
+	if _, err := p.Prepare(cmd, &User{}, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	flags := cmd.SysProcAttr.Cloneflags
+	if flags&syscall.CLONE_NEWPID == 0 || flags&syscall.CLONE_NEWUSER == 0 {
+		t.Errorf("default profile as root: %#x", flags)
+	}
+	if flags&syscall.CLONE_NEWTIME != 0 {
+		t.Errorf("clock is still enabled: %#x", flags)
+	}
+
+	cmd = exec.Command("true")
+	p = &Proc{Sandbox: "none", SandboxEnable: []string{"pid"}}
+	if _, err := p.Prepare(cmd, &User{}, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if flags := cmd.SysProcAttr.Cloneflags; flags != syscall.CLONE_NEWPID {
+		t.Errorf("none with pid: %#x", flags)
+	}
+
+	p = &Proc{Sandbox: "strict"}
+	if _, err := p.Prepare(exec.Command("true"), &User{UID: 65534, GID: 65534}, nil); err == nil {
+		t.Errorf("strict profile switched user without mappings")
+	}
+
+	p = &Proc{SandboxEnable: []string{"network"}}
+	if _, err := p.Prepare(exec.Command("true"), &User{}, nil); err == nil {
+		t.Errorf("unknown sandbox flag accepted")
+	}
+
+	p = &Proc{Sandbox: "none", PrivateRoot: true}
+	if _, err := p.Prepare(exec.Command("true"), &User{}, nil); err == nil {
+		t.Errorf("private root without a mount namespace accepted")
+	}
+}
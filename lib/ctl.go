@@ -0,0 +1,318 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+type AdminClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func DialAdmin(path string) (*AdminClient, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("admin: dial %s: %v", path, err)
+	}
+	return &AdminClient{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (a *AdminClient) Close() error {
+	return a.conn.Close()
+}
+
+func (a *AdminClient) Do(command string, args ...string) (*AdminResponse, error) {
+	if err := json.NewEncoder(a.conn).Encode(&AdminRequest{Command: command, Args: args}); err != nil {
+		return nil, err
+	}
+
+	line, err := a.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &AdminResponse{}
+	if err := json.Unmarshal(line, resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("%s", resp.Error)
+	}
+	return resp, nil
+}
+
+type Ctl struct {
+	Socket string `long:"socket" required:"true" description:"Path of the admin unix socket, the --admin.socket of the server"`
+	JSON   bool   `long:"json" description:"Print JSON instead of tables"`
+
+	out io.Writer
+}
+
+type ctlLs struct{ ctl *Ctl }
+type ctlConns struct{ ctl *Ctl }
+type ctlReload struct{ ctl *Ctl }
+type ctlUpgrade struct{ ctl *Ctl }
+
+type ctlKill struct {
+	ctl  *Ctl
+	Args struct {
+		IDs []string `positional-arg-name:"id" required:"1"`
+	} `positional-args:"yes"`
+}
+
+type ctlDrain struct {
+	ctl  *Ctl
+	Args struct {
+		Names []string `positional-arg-name:"name" required:"1"`
+	} `positional-args:"yes"`
+}
+
+type ctlRestart struct {
+	ctl  *Ctl
+	Args struct {
+		Names []string `positional-arg-name:"name" required:"1"`
+	} `positional-args:"yes"`
+}
+
+type ctlStats struct {
+	ctl      *Ctl
+	Watch    bool          `long:"watch" description:"Keep printing stats"`
+	Interval time.Duration `long:"interval" default:"1s" description:"Interval between updates with --watch"`
+}
+
+func CtlFunc(args []string) {
+	ctl := &Ctl{out: os.Stdout}
+	parser := flags.NewNamedParser("gopipe ctl", flags.Default)
+	if _, err := parser.AddGroup("ctl", "", ctl); err != nil {
+		panic(err)
+	}
+
+	commands := []struct {
+		name, short string
+		data        interface{}
+	}{
+		{"ls", "List configured connections", &ctlLs{ctl}},
+		{"conns", "List live proxied connections", &ctlConns{ctl}},
+		{"kill", "Close proxied connections by id", &ctlKill{ctl: ctl}},
+		{"drain", "Stop accepting new connections", &ctlDrain{ctl: ctl}},
+		{"restart", "Restart forked children", &ctlRestart{ctl: ctl}},
+		{"reload", "Reload TLS certificates", &ctlReload{ctl}},
+		{"upgrade", "Hand listeners to a newly started gopipe", &ctlUpgrade{ctl}},
+		{"stats", "Show connection counters", &ctlStats{ctl: ctl}},
+	}
+	for _, c := range commands {
+		if _, err := parser.AddCommand(c.name, c.short, "", c.data); err != nil {
+			panic(err)
+		}
+	}
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		if flags.WroteHelp(err) {
+			return
+		}
+		os.Exit(1)
+	}
+}
+
+func (c *Ctl) do(command string, args ...string) (*AdminResponse, error) {
+	client, err := DialAdmin(c.Socket)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.Do(command, args...)
+}
+
+func (c *Ctl) json(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *Ctl) table(header string, rows [][]string) error {
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func (l *ctlLs) Execute(args []string) error {
+	resp, err := l.ctl.do("ls")
+	if err != nil {
+		return err
+	}
+	if l.ctl.JSON {
+		return l.ctl.json(resp.Connections)
+	}
+
+	var rows [][]string
+	for _, s := range resp.Connections {
+		pids := make([]string, len(s.Pids))
+		for i, pid := range s.Pids {
+			pids[i] = fmt.Sprint(pid)
+		}
+		rows = append(rows, []string{
+			fmt.Sprint(s.ID), s.Name, s.Mode, s.Listen, s.Client,
+			orDash(strings.Join(pids, ",")), orDash(s.ListenNetNs), orDash(s.ClientNetNs),
+			fmt.Sprint(s.Active),
+		})
+	}
+	return l.ctl.table("ID\tNAME\tMODE\tLISTEN\tCLIENT\tPIDS\tLISTEN NETNS\tCLIENT NETNS\tACTIVE", rows)
+}
+
+func (l *ctlConns) Execute(args []string) error {
+	resp, err := l.ctl.do("conns")
+	if err != nil {
+		return err
+	}
+	if l.ctl.JSON {
+		return l.ctl.json(resp.Conns)
+	}
+
+	var rows [][]string
+	for _, s := range resp.Conns {
+		origin := "-"
+		if s.Meta != nil {
+			origin = s.Meta.details()
+		}
+		rows = append(rows, []string{
+			fmt.Sprint(s.ID), s.Connection, s.Remote, s.Local, orDash(s.Upstream),
+			time.Since(s.Started).Truncate(time.Second).String(),
+			formatBytes(s.BytesIn), formatBytes(s.BytesOut), origin,
+		})
+	}
+	return l.ctl.table("ID\tCONNECTION\tREMOTE\tLOCAL\tUPSTREAM\tAGE\tIN\tOUT\tORIGIN", rows)
+}
+
+func (k *ctlKill) Execute(args []string) error {
+	_, err := k.ctl.do("kill", k.Args.IDs...)
+	return err
+}
+
+func (d *ctlDrain) Execute(args []string) error {
+	_, err := d.ctl.do("drain", d.Args.Names...)
+	return err
+}
+
+func (r *ctlRestart) Execute(args []string) error {
+	_, err := r.ctl.do("restart", r.Args.Names...)
+	return err
+}
+
+func (r *ctlReload) Execute(args []string) error {
+	_, err := r.ctl.do("reload")
+	return err
+}
+
+func (u *ctlUpgrade) Execute(args []string) error {
+	_, err := u.ctl.do("upgrade")
+	return err
+}
+
+func (s *ctlStats) Execute(args []string) error {
+	client, err := DialAdmin(s.ctl.Socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	previous := map[int]ConnectionStatus{}
+	last := time.Now()
+	for {
+		resp, err := client.Do("ls")
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		elapsed := now.Sub(last).Seconds()
+		last = now
+
+		if s.ctl.JSON {
+			if err := json.NewEncoder(s.ctl.out).Encode(resp.Connections); err != nil {
+				return err
+			}
+		} else {
+			var rows [][]string
+			for _, c := range resp.Connections {
+				row := []string{
+					c.Name, fmt.Sprint(c.Active), fmt.Sprint(c.Accepted),
+					formatBytes(c.BytesIn), formatBytes(c.BytesOut),
+				}
+				p, ok := previous[c.ID]
+				if ok && elapsed > 0 {
+					row = append(row,
+						formatBytes(uint64(float64(c.BytesIn-p.BytesIn)/elapsed))+"/s",
+						formatBytes(uint64(float64(c.BytesOut-p.BytesOut)/elapsed))+"/s")
+				} else {
+					row = append(row, "-", "-")
+				}
+				row = append(row, cgroupColumns(c, p, ok, elapsed)...)
+				rows = append(rows, row)
+				previous[c.ID] = c
+			}
+			if s.Watch {
+				fmt.Fprint(s.ctl.out, "\033[H\033[2J")
+			}
+			if err := s.ctl.table("NAME\tACTIVE\tACCEPTED\tIN\tOUT\tIN RATE\tOUT RATE\tMEM\tPIDS\tCPU", rows); err != nil {
+				return err
+			}
+		}
+
+		if !s.Watch {
+			return nil
+		}
+		time.Sleep(s.Interval)
+	}
+}
+
+// cgroupColumns sums up the usage of the cgroups of the children of c,
+// CPU as a percentage of one CPU since previous.
+func cgroupColumns(c, previous ConnectionStatus, ok bool, elapsed float64) []string {
+	if len(c.CGroups) == 0 {
+		return []string{"-", "-", "-"}
+	}
+	var mem, pids, cpu, prevCPU uint64
+	for _, u := range c.CGroups {
+		mem, pids, cpu = mem+u.MemoryCurrent, pids+u.Pids, cpu+u.CPUUsec
+	}
+	for _, u := range previous.CGroups {
+		prevCPU += u.CPUUsec
+	}
+	rate := "-"
+	if ok && elapsed > 0 && cpu >= prevCPU && len(previous.CGroups) > 0 {
+		rate = fmt.Sprintf("%.1f%%", float64(cpu-prevCPU)/elapsed/1e4)
+	}
+	return []string{formatBytes(mem), fmt.Sprint(pids), rate}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
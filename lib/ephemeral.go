@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// ephemeralNetNs is a namespace created by us, it's removed again with
+// everything we added to it.
+type ephemeralNetNs struct {
+	handle netns.NsHandle
+	name   string
+	link   string
+}
+
+// createNetNs creates a namespace with loopback up, named if name is
+// set. veth is host-cidr,ns-cidr and connects it to the current
+// namespace, the host side is the default gateway in the namespace.
+func createNetNs(name, veth string) (*ephemeralNetNs, error) {
+	var hostAddr, nsAddr *netlink.Addr
+	if veth != "" {
+		host, ns, ok := strings.Cut(veth, ",")
+		if !ok {
+			return nil, fmt.Errorf("veth %q is not host-cidr,ns-cidr", veth)
+		}
+		var err error
+		if hostAddr, err = netlink.ParseAddr(host); err != nil {
+			return nil, fmt.Errorf("veth: %v", err)
+		}
+		if nsAddr, err = netlink.ParseAddr(ns); err != nil {
+			return nil, fmt.Errorf("veth: %v", err)
+		}
+	}
+
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("netns: Get: %v", err)
+	}
+	defer origin.Close()
+
+	// New moves the thread into the namespace it creates.
+	var h netns.NsHandle
+	if name != "" {
+		h, err = netns.NewNamed(name)
+	} else {
+		h, err = netns.New()
+	}
+	if serr := netns.Set(origin); serr != nil {
+		// The thread stays locked and is thrown away with the goroutine.
+		if err == nil {
+			h.Close()
+		}
+		return nil, fmt.Errorf("failed to switch back to ns: %v", serr)
+	}
+	runtime.UnlockOSThread()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &ephemeralNetNs{handle: h, name: name}
+	if err := e.setup(hostAddr, nsAddr); err != nil {
+		e.remove()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *ephemeralNetNs) setup(hostAddr, nsAddr *netlink.Addr) error {
+	nsh, err := netlink.NewHandleAt(e.handle)
+	if err != nil {
+		return err
+	}
+	defer nsh.Close()
+
+	lo, err := nsh.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("lo: %v", err)
+	}
+	if err := nsh.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("lo: %v", err)
+	}
+
+	if hostAddr == nil {
+		return nil
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	veth := &netlink.Veth{
+		LinkAttrs:     netlink.LinkAttrs{Name: "gp" + hex.EncodeToString(id)},
+		PeerName:      "eth0",
+		PeerNamespace: netlink.NsFd(e.handle),
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("veth: %v", err)
+	}
+	e.link = veth.Name
+
+	host, err := netlink.LinkByName(e.link)
+	if err != nil {
+		return fmt.Errorf("veth: %v", err)
+	}
+	if err := netlink.AddrAdd(host, hostAddr); err != nil {
+		return fmt.Errorf("veth: %s: %v", hostAddr, err)
+	}
+	if err := netlink.LinkSetUp(host); err != nil {
+		return fmt.Errorf("veth: %v", err)
+	}
+
+	peer, err := nsh.LinkByName("eth0")
+	if err != nil {
+		return fmt.Errorf("veth: %v", err)
+	}
+	if err := nsh.AddrAdd(peer, nsAddr); err != nil {
+		return fmt.Errorf("veth: %s: %v", nsAddr, err)
+	}
+	if err := nsh.LinkSetUp(peer); err != nil {
+		return fmt.Errorf("veth: %v", err)
+	}
+	if err := nsh.RouteAdd(&netlink.Route{LinkIndex: peer.Attrs().Index, Gw: hostAddr.IP}); err != nil {
+		return fmt.Errorf("veth: default route via %s: %v", hostAddr.IP, err)
+	}
+	return nil
+}
+
+// remove deletes the veth pair and the name of the namespace, the
+// namespace itself is gone once nothing uses it anymore.
+func (e *ephemeralNetNs) remove() error {
+	var errors []string
+	if e.link != "" {
+		if l, err := netlink.LinkByName(e.link); err == nil {
+			if err := netlink.LinkDel(l); err != nil {
+				errors = append(errors, fmt.Sprintf("%s: %v", e.link, err))
+			}
+		}
+	}
+	e.handle.Close()
+	if e.name != "" {
+		if err := netns.DeleteNamed(e.name); err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", e.name, err))
+		}
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, ", "))
+	}
+	return nil
+}
@@ -1,110 +1,158 @@
 package lib
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
-
-	"os/exec"
-
-	"github.com/ftrvxmtrx/fd"
+	"time"
 )
 
 type ForkClientProxy struct {
 	ClientProc *Proc
 	ListenProc *Proc
-	ClientCmd  *exec.Cmd
-	ListenCmd  *exec.Cmd
+	ClientCmd  *Child
+	ListenCmd  *Child
 	Ln         net.Listener
-}
-
-func (f *ForkClientProxy) listen(l *Listen) (ln net.Listener, err error) {
-	if l.IsFd() {
-		ln, err = l.GetListener(l.TLS.config)
-		if err != nil {
-			return
-		}
-	} else {
-		ln, err = net.Listen(l.Protocol, l.GetAddr())
-		if err != nil {
-			return
-		}
-	}
 
-	if l.TLS.config != nil {
-		ln = tls.NewListener(ln, l.TLS.config)
-	}
+	mu         sync.Mutex
+	conn       *net.UnixConn
+	listen     *Listen
+	client     *Client
+	conns      *Tracker
+	sending    sync.WaitGroup
+	draining   atomic.Bool
+	supervisor *Supervisor
+	errCh      chan error
 
-	return
+	// Handshakes still going on when draining are given up.
+	handshakeCtx     context.Context
+	cancelHandshakes context.CancelFunc
 }
 
 func (f *ForkClientProxy) dial(c *Client) (*net.UnixConn, error) {
-	pipe := &Pipe{}
-	conns, err := pipe.Unixpair()
+	cfg := &ChildConfig{Role: "client", Listen: f.listen, Client: c, DrainTimeout: c.drainTimeout, ReportActive: true}
+	child, uc, err := ForkChild(c.Ctx, c.Proc, c.User, &c.NetNs, cfg, nil)
 	if err != nil {
 		return nil, err
 	}
-	args := []string{fmt.Sprintf("--client.addr=%s", c.GetAddr()), "--listen.addr=FD:3", "--listen.conn"}
-	args = append(args, c.TLS.Args("client.tls")...)
-	//fmt.Printf("forking %s %v\n", os.Args[0], args)
+	f.mu.Lock()
+	f.ClientCmd = child
+	f.mu.Unlock()
+
+	go f.wait(child)
+	go f.read(uc)
+
+	return uc, nil
+}
 
-	cmd := exec.CommandContext(c.Ctx, os.Args[0], args...)
+// read keeps track of the connections that are active in the child
+// behind uc, until it exits.
+func (f *ForkClientProxy) read(uc *net.UnixConn) {
+	active := 0
+	defer func() {
+		f.conns.AddRemote(-active)
+	}()
 
-	cloneflags, err := NewCloneflags()
+	viaf, err := uc.File()
 	if err != nil {
-		return nil, err
+		return
 	}
+	defer viaf.Close()
 
-	cloneflags.PrivateMounts = true
-	cloneflags.PrivatePID = true
-	if c.UID == 0 && c.GID == 0 {
-		cloneflags.PrivateUsers = true
+	for {
+		m, err := ReadMsg(int(viaf.Fd()), "remote")
+		if err != nil {
+			return
+		}
+		if m.File != nil {
+			m.File.Close()
+		}
+		n, err := m.Active()
+		if err != nil {
+			continue
+		}
+		f.conns.AddRemote(n - active)
+		active = n
 	}
-	cloneflags.PrivateUTS = true
-	// hangs child process
-	// cloneflags.PrivateTLS = true
-	cloneflags.PrivateIO = true
-	cloneflags.PrivateIPC = true
-	cloneflags.PrivateClock = true
-	cloneflags.PrivateCGroup = true
-
-	f.ClientProc = &Proc{Cloneflags: cloneflags}
+}
 
-	if err := f.ClientProc.SetUserGroup(c.User); err != nil {
-		return nil, err
+// wait starts a new client child when cmd exits, if its supervisor says
+// so. Connections accepted meanwhile are closed. Otherwise Proxy stops
+// accepting and returns.
+func (f *ForkClientProxy) wait(cmd *Child) {
+	started := time.Now()
+	err := exitError(cmd.Wait())
+	f.mu.Lock()
+	current := f.ClientCmd == cmd
+	f.mu.Unlock()
+	// A replaced child is drained by Restart.
+	if !current || f.draining.Load() {
+		return
 	}
 
-	f.ClientProc.SetSysProcAttr(cmd)
-
-	cmd.ExtraFiles, cmd.Stdout, cmd.Stderr = []*os.File{pipe.Files[1]}, os.Stdout, os.Stderr
-
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-	err, _ = c.NetNs.Enter()
-	if err != nil {
-		return nil, err
+	delay, restart, serr := f.supervisor.Next(err, time.Since(started), time.Now())
+	if !restart {
+		f.stop(serr)
+		return
 	}
-	defer c.NetNs.Close()
-	if err := cmd.Start(); err != nil {
-		if err, ok := err.(*exec.ExitError); ok {
-			return nil, fmt.Errorf("unable to start process: %v, %s, %s", err, err.Stderr, cmd.Environ())
-		}
-		return nil, fmt.Errorf("unable to start process: %v", err)
+	fmt.Printf("Error: %s: client child %d exited: %v, restarting in %s\n", f.client.GetAddr(), cmd.Pid(), err, delay)
+	if !sleepContext(f.client.Ctx, delay) {
+		return
 	}
 
-	uc, ok := conns[0].(*net.UnixConn)
-	if !ok {
-		return nil, fmt.Errorf("unable to convert conn to unixconn")
+	f.mu.Lock()
+	current = f.ClientCmd == cmd
+	f.mu.Unlock()
+	if !current || f.draining.Load() {
+		return
 	}
-	f.ClientCmd = cmd
+	u, err := f.dial(f.client)
+	if err != nil {
+		f.stop(err)
+		return
+	}
+	f.mu.Lock()
+	old := f.conn
+	f.conn = u
+	f.mu.Unlock()
+	old.Close()
+}
 
-	return uc, nil
+// stop makes Proxy return err.
+func (f *ForkClientProxy) stop(err error) {
+	select {
+	case f.errCh <- err:
+	default:
+	}
+	f.Ln.Close()
 }
 
-func (f *ForkClientProxy) send(u *net.UnixConn, src net.Conn) error {
+func (f *ForkClientProxy) send(id uint64, src net.Conn) error {
+	defer f.sending.Done()
+
+	// The handshake tells what goes with the connection.
+	t, ok := src.(*tls.Conn)
+	if ok {
+		if err := t.HandshakeContext(f.handshakeCtx); err != nil {
+			t.Close()
+			return err
+		}
+	}
+	meta := NewConnMeta(id, src)
+	if ok {
+		var err error
+		if src, err = TerminateTLS(t); err != nil {
+			t.Close()
+			return err
+		}
+	}
+	defer src.Close()
+
 	rawConn, err := src.(syscall.Conn).SyscallConn()
 	if err != nil {
 		return err
@@ -117,50 +165,128 @@ func (f *ForkClientProxy) send(u *net.UnixConn, src net.Conn) error {
 		return err
 	}
 
-	return fd.Put(u, os.NewFile(uintptr(connFd), "remote"))
+	// Hold the lock while sending so Restart and Drain see every
+	// connection either before or after they swap the channel.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return Put(f.conn, os.NewFile(uintptr(connFd), "remote"), meta)
 }
 
 func (f *ForkClientProxy) Close() error {
+	if f.Ln == nil {
+		return nil
+	}
 	return f.Ln.Close()
 }
 
+// Drain stops accepting, lets the client child know that nothing more
+// is sent and waits for it to finish.
+func (f *ForkClientProxy) Drain(timeout time.Duration) error {
+	if f.draining.Swap(true) {
+		return nil
+	}
+	if f.Ln == nil {
+		return nil
+	}
+	if err := f.Ln.Close(); err != nil {
+		return err
+	}
+	f.cancelHandshakes()
+	f.sending.Wait()
+
+	f.mu.Lock()
+	child, u := f.ClientCmd, f.conn
+	f.mu.Unlock()
+	if child == nil {
+		return nil
+	}
+	return child.Drain(u, timeout)
+}
+
+func (f *ForkClientProxy) Pids() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ClientCmd.Pid() == 0 {
+		return nil
+	}
+	return []int{f.ClientCmd.Pid()}
+}
+
+// Reload asks the client child to read its certificates again.
+func (f *ForkClientProxy) Reload() error {
+	// Not in the middle of a connection that is sent.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn == nil {
+		return fmt.Errorf("no client child")
+	}
+	return WriteMsgConn(f.conn, &Msg{Type: MsgReload})
+}
+
+// Restart forks a new client process and hands all new connections to
+// it, the old process is drained and keeps its connections.
+func (f *ForkClientProxy) Restart() error {
+	f.mu.Lock()
+	old, oldConn := f.ClientCmd, f.conn
+	f.mu.Unlock()
+
+	u, err := f.dial(f.client)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.conn = u
+	f.mu.Unlock()
+
+	go func() {
+		if err := old.Drain(oldConn, f.client.drainTimeout); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		oldConn.Close()
+	}()
+	return nil
+}
+
 func (f *ForkClientProxy) Proxy(l *Listen, c *Client) (err error) {
-	f.Ln, err = f.listen(l)
+	f.handshakeCtx, f.cancelHandshakes = context.WithCancel(c.Ctx)
+	defer f.cancelHandshakes()
+	f.Ln, err = l.Listener()
 	if err != nil {
 		return
 	}
 
-	u, err := f.dial(c)
+	f.listen, f.client, f.conns, f.supervisor = l, c, l.conns, c.Proc.supervisor()
+	f.errCh = make(chan error, 1)
+	f.conn, err = f.dial(c)
 	if err != nil {
 		return
 	}
-	defer f.ClientCmd.Cancel()
-
-	// Make sure ln is closed if cmd exits
-	go func() {
-		if err := f.ClientCmd.Wait(); err != nil {
-			if err, ok := err.(*exec.ExitError); ok {
-				fmt.Printf("unable to start process: %v, %s", err, err.Stderr)
-				return
-			}
-			fmt.Printf("unable to start process: %v", err)
+	defer func() {
+		// Drain takes care of the child.
+		if f.draining.Load() {
+			return
 		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.ClientCmd.Cancel()
 	}()
 
 	var src net.Conn
 	for {
 		if src, err = f.Ln.Accept(); err != nil {
-			return
-		}
-
-		if t, ok := src.(*tls.Conn); ok {
-			src, err = TerminateTLS(t)
-			if err != nil {
-				src.Close()
-				continue
+			if f.draining.Load() {
+				return nil
 			}
+			select {
+			case err = <-f.errCh:
+			default:
+			}
+			return
 		}
+		id := l.conns.Accepted()
 
-		go f.send(u, src)
+		f.sending.Add(1)
+		go f.send(id, src)
 	}
 }
@@ -5,105 +5,220 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"runtime"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"os/exec"
+	"golang.org/x/sys/unix"
 )
 
 type ForkListenForkClientProxy struct {
 	ClientProc *Proc
 	ListenProc *Proc
-	ClientCmd  *exec.Cmd
-	ListenCmd  *exec.Cmd
+	ClientCmd  *Child
+	ListenCmd  *Child
 	Ctx        context.Context
 	Cancel     context.CancelCauseFunc
-}
 
-func (f *ForkListenForkClientProxy) listen(l *Listen) (*net.UnixConn, error) {
+	mu         sync.Mutex
+	conn       *net.UnixConn
+	listener   chan *os.File
+	held       *os.File
+	draining   atomic.Bool
+	supervisor *Supervisor
+}
 
-	bin := os.Args[0]
-	args := []string{}
-	if e := os.Getenv("CMD_LISTEN_FORK_ARGS"); e != "" {
-		args = append(args, strings.Split(e, " ")...)
+// listen forks the listening child, it passes connections on over pass
+// and is asked to drain or hand over its listener over the returned
+// channel.
+func (f *ForkListenForkClientProxy) listen(l *Listen, c *Client, pass *os.File) (*Child, *net.UnixConn, error) {
+	cfg := &ChildConfig{Role: "listen", Listen: l, Client: c, DrainTimeout: l.drainTimeout, Conn: 4}
+	if l.inherited != nil {
+		// Let the child accept on the listener we were handed.
+		defer func() {
+			l.inherited.Close()
+			l.inherited = nil
+		}()
 	}
-	args = append(args, fmt.Sprintf("--listen.addr=%s", l.GetAddr()), "--client.addr=FD:3")
-	args = append(args, l.TLS.Args("listen.tls")...)
-	args = append(args, "--listen.netns.disable", "--client.netns.disable")
+	return ForkChild(f.Ctx, l.Proc, l.User, &l.NetNs, cfg, l.inherited, pass)
+}
 
-	cmd, uc, err := ForkUnixConn(l.Ctx, l.User, &l.NetNs, bin, args...)
+// dial forks the client child, it's passed connections over pass by
+// the listening child.
+func (f *ForkListenForkClientProxy) dial(l *Listen, c *Client, pass *os.File) (*Child, error) {
+	cfg := &ChildConfig{Role: "client", Listen: l, Client: c, DrainTimeout: c.drainTimeout, Conn: 4}
+	child, uc, err := ForkChild(f.Ctx, c.Proc, c.User, &c.NetNs, cfg, nil, pass)
 	if err != nil {
 		return nil, err
 	}
-	f.ListenCmd = cmd
-	return uc, nil
+	// Only the config went over it.
+	uc.Close()
+	return child, nil
 }
 
-func (f *ForkListenForkClientProxy) dial(c *Client, conn *net.UnixConn, ch chan struct{}) error {
-	closed := false
-	defer func() {
-		if !closed {
-			close(ch)
-		}
-	}()
-	cmdBin := os.Args[0]
-	args := []string{}
-	if e := os.Getenv("CMD_CLIENT_FORK_ARGS"); e != "" {
-		args = append(args, strings.Split(e, " ")...)
+// run forks a listening and a client child, the listening one passes
+// connections straight to the other over a socketpair of their own. It
+// waits for one of them to exit and stops the other one. listenExited
+// tells which one exited first and exitErr how, err is set if they
+// couldn't be started.
+func (f *ForkListenForkClientProxy) run(l *Listen, c *Client) (listenExited bool, exitErr error, err error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return true, nil, fmt.Errorf("socketpair: %v", err)
 	}
-	args = append(args, fmt.Sprintf("--client.addr=%s", c.GetAddr()), "--listen.addr=FD:3", "--listen.conn")
-	args = append(args, c.TLS.Args("client.tls")...)
-	args = append(args, "--listen.netns.disable", "--client.netns.disable")
-	//fmt.Printf("forking %s %v\n", cmdBin, args)
-
-	f.ClientCmd = exec.CommandContext(f.Ctx, cmdBin, args...)
+	pass := [2]*os.File{os.NewFile(uintptr(fds[0]), "listen"), os.NewFile(uintptr(fds[1]), "client")}
+	// The children have their own copies once started.
+	defer pass[0].Close()
+	defer pass[1].Close()
 
-	cloneflags, err := NewCloneflags()
+	listenCmd, conn, err := f.listen(l, c, pass[0])
 	if err != nil {
-		return err
+		return true, nil, err
+	}
+	defer conn.Close()
+	clientCmd, err := f.dial(l, c, pass[1])
+	if err != nil {
+		listenCmd.Process.Signal(os.Interrupt)
+		listenCmd.Wait()
+		return false, nil, err
+	}
+	pass[0].Close()
+	pass[1].Close()
+
+	f.mu.Lock()
+	f.ListenCmd, f.ClientCmd, f.conn = listenCmd, clientCmd, conn
+	f.mu.Unlock()
+	go f.read(conn)
+	if f.supervisor.Policy != "never" {
+		go f.hold(l, listenCmd)
 	}
 
-	cloneflags.PrivateMounts = true
-	cloneflags.PrivatePID = true
-	if c.UID == 0 && c.GID == 0 {
-		cloneflags.PrivateUsers = true
+	first, other := listenCmd, clientCmd
+	select {
+	case <-listenCmd.Done():
+		listenExited = true
+	case <-clientCmd.Done():
+		first, other = clientCmd, listenCmd
+	case <-f.Ctx.Done():
+	}
+	// While draining both exit by themselves.
+	if !f.draining.Load() {
+		listenCmd.Process.Signal(os.Interrupt)
+		clientCmd.Process.Signal(os.Interrupt)
 	}
-	cloneflags.PrivateUTS = true
-	// hangs child process
-	// cloneflags.PrivateTLS = true
-	cloneflags.PrivateIO = true
-	cloneflags.PrivateIPC = true
-	cloneflags.PrivateClock = true
-	cloneflags.PrivateCGroup = true
+	other.Wait()
 
-	f.ClientProc = &Proc{Cloneflags: cloneflags}
+	// Drain has nothing left to tell them.
+	f.mu.Lock()
+	f.conn = nil
+	f.mu.Unlock()
+	return listenExited, exitError(first.Wait()), nil
+}
 
-	if err := f.ClientProc.SetUserGroup(c.User); err != nil {
-		return err
+// hold keeps a copy of the listener of cmd, the listening child started
+// after cmd has exited accepts on it. Connections wait in its backlog
+// meanwhile.
+func (f *ForkListenForkClientProxy) hold(l *Listen, cmd *Child) {
+	file, err := f.Listener()
+	if err != nil {
+		fmt.Printf("Warning: %s: %v, it's bound again on restart\n", l.GetAddr(), err)
+		return
+	}
+	f.mu.Lock()
+	if f.ListenCmd != cmd {
+		f.mu.Unlock()
+		file.Close()
+		return
+	}
+	old := f.held
+	f.held = file
+	f.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// release closes the copy of the listener, once nothing accepts on it
+// anymore it should refuse connections.
+func (f *ForkListenForkClientProxy) release() {
+	f.mu.Lock()
+	held := f.held
+	f.held = nil
+	f.mu.Unlock()
+	if held != nil {
+		held.Close()
+	}
+}
+
+// read takes the listeners the listening child sends back on conn,
+// until it exits.
+func (f *ForkListenForkClientProxy) read(conn *net.UnixConn) {
+	ln := &UnixConnListener{UnixConn: conn, OnListener: func(file *os.File) {
+		offerListener(f.listener, file)
+	}}
+	for {
+		src, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		src.Close()
 	}
+}
+
+// Listener asks the listening child for a copy of its listener.
+func (f *ForkListenForkClientProxy) Listener() (*os.File, error) {
+	f.mu.Lock()
+	cmd, conn := f.ListenCmd, f.conn
+	f.mu.Unlock()
+	return askListener(cmd, conn, f.listener)
+}
 
-	f.ClientProc.SetSysProcAttr(f.ClientCmd)
+func (f *ForkListenForkClientProxy) Pids() (pids []int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, cmd := range []*Child{f.ListenCmd, f.ClientCmd} {
+		if pid := cmd.Pid(); pid != 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return
+}
 
-	fc, _ := conn.File()
-	f.ClientCmd.ExtraFiles, f.ClientCmd.Stdout, f.ClientCmd.Stderr = []*os.File{fc}, os.Stdout, os.Stderr
+// Drain asks the listening child to stop accepting, it passes the drain
+// on to the client child. Both children are given timeout to finish.
+func (f *ForkListenForkClientProxy) Drain(timeout time.Duration) error {
+	f.mu.Lock()
+	listenCmd, clientCmd, conn := f.ListenCmd, f.ClientCmd, f.conn
+	f.mu.Unlock()
+	if f.draining.Swap(true) || listenCmd == nil {
+		return nil
+	}
+	f.release()
 
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-	err, _ = c.NetNs.Enter()
-	if err != nil {
-		return err
+	var via OSFile
+	if conn != nil {
+		via = conn
 	}
-	defer c.NetNs.Close()
-	if err := f.ClientCmd.Start(); err != nil {
-		if err, ok := err.(*exec.ExitError); ok {
-			return fmt.Errorf("unable to start process: %v, %s, %s", err, err.Stderr, f.ClientCmd.Environ())
+	deadline := time.Now().Add(timeout)
+	err := listenCmd.Drain(via, timeout)
+	if clientCmd != nil {
+		if cerr := clientCmd.Drain(nil, time.Until(deadline)); err == nil {
+			err = cerr
 		}
-		return fmt.Errorf("unable to start process: %v", err)
 	}
-	close(ch)
-	closed = true
+	return err
+}
 
-	return f.ClientCmd.Wait()
+// Reload asks the listening child to read its certificates again, it
+// passes it on to the client child.
+func (f *ForkListenForkClientProxy) Reload() error {
+	f.mu.Lock()
+	conn := f.conn
+	f.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("no listening child")
+	}
+	return WriteMsgConn(conn, &Msg{Type: MsgReload})
 }
 
 func (f *ForkListenForkClientProxy) Close() error {
@@ -111,50 +226,48 @@ func (f *ForkListenForkClientProxy) Close() error {
 	return nil
 }
 
+// Proxy runs the pair of children, when one of them exits both are
+// started again if the supervisor of the one that exited says so.
 func (f *ForkListenForkClientProxy) Proxy(l *Listen, c *Client) error {
 	f.Ctx, f.Cancel = context.WithCancelCause(l.Ctx)
+	f.listener = make(chan *os.File, 1)
+	defer f.Cancel(nil)
+	defer f.release()
+	f.supervisor = l.Proc.supervisor()
+	listenSupervisor, clientSupervisor := f.supervisor, c.Proc.supervisor()
 
-	var src net.Conn
-	var err error
-	listenCh := make(chan struct{})
-
-	go func() {
-		src, err = f.listen(l)
+	for {
+		started := time.Now()
+		listenExited, exitErr, err := f.run(l, c)
 		if err != nil {
-			f.Cancel(err)
-			close(listenCh)
-			return
+			return err
 		}
-		close(listenCh)
-		defer src.Close()
-
-		if err := f.ListenCmd.Wait(); err != nil {
-			if er, ok := err.(*exec.ExitError); ok {
-				err = fmt.Errorf("process exited: %v, %s", er, er.Stderr)
-			}
-			f.Cancel(err)
+		if f.draining.Load() {
+			return nil
+		}
+		if f.Ctx.Err() != nil {
+			return context.Cause(f.Ctx)
 		}
-	}()
-
-	clientCh := make(chan struct{})
 
-	go func() {
-		select {
-		case <-listenCh:
-			defer f.ListenCmd.Process.Signal(os.Interrupt)
-			break
-		case <-f.Ctx.Done():
-			return
+		side, supervisor := "client", clientSupervisor
+		if listenExited {
+			side, supervisor = "listening", listenSupervisor
+		}
+		delay, restart, err := supervisor.Next(exitErr, time.Since(started), time.Now())
+		if !restart {
+			return err
+		}
+		fmt.Printf("Error: %s: %s child exited: %v, restarting both in %s\n", l.GetAddr(), side, exitErr, delay)
+		if !sleepContext(f.Ctx, delay) {
+			return context.Cause(f.Ctx)
 		}
-		defer src.Close()
-		f.Cancel(f.dial(c, src.(*net.UnixConn), clientCh))
-	}()
 
-	<-clientCh
-	if f.ClientCmd != nil {
-		defer f.ClientCmd.Process.Signal(os.Interrupt)
+		f.mu.Lock()
+		if f.held != nil {
+			if l.inherited, err = dupFile(f.held); err != nil {
+				fmt.Printf("Error: %s: %v\n", l.GetAddr(), err)
+			}
+		}
+		f.mu.Unlock()
 	}
-
-	<-f.Ctx.Done()
-	return f.Ctx.Err()
 }
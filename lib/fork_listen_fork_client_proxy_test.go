@@ -2,10 +2,21 @@ package lib
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -33,11 +44,11 @@ func TestFDPassthrough(t *testing.T) {
 			ch <- err
 			return
 		}
-		if err = PutFd(pipe.Fds[0], file); err != nil {
+		if err = PutFd(pipe.Fds[0], file, nil); err != nil {
 			ch <- err
 			return
 		}
-		file, err = GetFd(pipe.Fds[1], "socket")
+		file, _, err = GetFd(pipe.Fds[1], "socket")
 		if err != nil {
 			ch <- err
 			return
@@ -96,7 +107,9 @@ func TestFDPassthrough2(t *testing.T) {
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
-	ch := make(chan error)
+	// CopyUnix may fail once the test is done, it must not block or
+	// send on a closed channel then.
+	ch := make(chan error, 2)
 	go func(ch chan error) {
 		if err := CopyUnix(c2[0], c1[1]); err != nil {
 			ch <- err
@@ -121,12 +134,12 @@ func TestFDPassthrough2(t *testing.T) {
 			ch <- err
 			return
 		}
-		if err = Put(c1[0].(*net.UnixConn), file); err != nil {
+		if err = Put(c1[0].(*net.UnixConn), file, nil); err != nil {
 			ch <- err
 			return
 		}
 		// It's actually needed to use the FileConn here and not Fds or Files from pipe2
-		file, err = Get(c2[1].(*net.UnixConn), "socket")
+		file, _, err = Get(c2[1].(*net.UnixConn), "socket")
 		if err != nil {
 			ch <- err
 			return
@@ -153,7 +166,6 @@ func TestFDPassthrough2(t *testing.T) {
 		}
 		ln.Close()
 		ch <- nil
-		close(ch)
 	}(ch)
 	conn, err := net.Dial("tcp", ln.Addr().String())
 	if err != nil {
@@ -183,7 +195,9 @@ func TestFDPassthrough3(t *testing.T) {
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
-	ch := make(chan error)
+	// CopyUnix may fail once the test is done, it must not block or
+	// send on a closed channel then.
+	ch := make(chan error, 2)
 	go func(ch chan error) {
 		if err := CopyUnix(c2[0], c1[1]); err != nil {
 			ch <- err
@@ -208,12 +222,12 @@ func TestFDPassthrough3(t *testing.T) {
 			ch <- err
 			return
 		}
-		if err = PutFd(int(pipe1.Files[0].Fd()), file); err != nil {
+		if err = PutFd(int(pipe1.Files[0].Fd()), file, nil); err != nil {
 			ch <- err
 			return
 		}
 		// It's actually needed to use the FileConn here and not Fds or Files from pipe2
-		file, err = Get(c2[1].(*net.UnixConn), "socket")
+		file, _, err = Get(c2[1].(*net.UnixConn), "socket")
 		if err != nil {
 			ch <- err
 			return
@@ -240,7 +254,6 @@ func TestFDPassthrough3(t *testing.T) {
 		}
 		ln.Close()
 		ch <- nil
-		close(ch)
 	}(ch)
 	conn, err := net.Dial("tcp", ln.Addr().String())
 	if err != nil {
@@ -259,71 +272,129 @@ func TestFDPassthrough3(t *testing.T) {
 	}
 }
 
+// TestForkListenForkClientE2E runs both forked children in namespaces
+// of their own, the listening one is dialed and the client one dials
+// back over veth pairs.
 func TestForkListenForkClientE2E(t *testing.T) {
-	ch := make(chan struct{})
-	connCh := make(chan net.Conn)
+	forkE2E(t, nil)
+}
+
+// TestForkListenForkClientSeccompE2E is the same with both children
+// killed on syscalls outside their allow-list, and TLS terminated by
+// the listening one.
+func TestForkListenForkClientSeccompE2E(t *testing.T) {
+	certFile, keyFile, pool := writeCert(t, "gopipe.test")
+	forkE2E(t, &tls.Config{ServerName: "gopipe.test", RootCAs: pool},
+		"--listen.seccomp=kill", "--client.seccomp=kill",
+		"--listen.tls.cert-file="+certFile, "--listen.tls.key-file="+keyFile)
+}
 
-	ln1, err := net.Listen("tcp", "127.0.0.1:0")
+// writeCert writes a self-signed certificate for name and its key.
+func writeCert(t *testing.T, name string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
-	addr1 := ln1.Addr().String()
-	ln1.Close()
-
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
-	addr := fmt.Sprintf("--client.addr=%s", ln.Addr().String())
 
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0o600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+// forkE2E dials the listening child with TLS when config is set.
+func forkE2E(t *testing.T, config *tls.Config, args ...string) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create namespaces")
+	}
+
+	// Any address, the one on the host side of the client veth pair
+	// is only there once gopipe has created it.
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
 	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
 	ctx, cancel := context.WithCancelCause(context.Background())
-	go func(connCh chan net.Conn) {
-		defer ln.Close()
+	connCh := make(chan net.Conn)
+	go func() {
 		defer close(connCh)
-		close(ch)
-		conn, err := ln.Accept()
-		if err != nil {
-			cancel(err)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				cancel(err)
+				return
+			}
+			// Only what came over the client veth pair counts.
+			if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "10.213.2.2" {
+				conn.Close()
+				continue
+			}
+			connCh <- conn
 			return
 		}
-		connCh <- conn
-		cancel(nil)
-	}(connCh)
-
-	payload := "hello there"
+	}()
 
-	<-ch
-
-	if len(ctx.Done()) > 0 {
-		t.Fatalf("%v", ctx.Err())
-	}
-
-	args := []string{"-test.run", "^TestE2EBin$", "-test.timeout", "20s", "--", "--listen.fork", fmt.Sprintf("--listen.addr=%s", addr1), "--client.fork", addr}
+	listenAddr := "10.213.1.2:8080"
+	args = append([]string{"-test.run", "^TestE2EBin$", "-test.timeout", "20s", "--",
+		"--listen.fork", "--listen.addr=" + listenAddr,
+		"--listen.netns.create", "--listen.netns.veth=10.213.1.1/30,10.213.1.2/30",
+		"--client.fork", "--client.addr=" + net.JoinHostPort("10.213.2.1", port),
+		"--client.netns.create", "--client.netns.veth=10.213.2.1/30,10.213.2.2/30",
+		"--drain-timeout=1s"}, args...)
 	l := exec.CommandContext(ctx, os.Args[0], args...)
-	l.Env = []string{
-		`CMD_TEST_E2E=1`,
-		`CMD_LISTEN_FORK_ARGS=-test.run ^TestE2EBin$ -test.timeout 20s --`,
-		`CMD_CLIENT_FORK_ARGS=-test.run ^TestE2EBin$ -test.timeout 20s --`,
-	}
+	l.Env = []string{`CMD_TEST_E2E=1`}
 	l.Stdout, l.Stderr = os.Stdout, os.Stderr
-
-	if err := l.Start(); err != nil {
-		if err, ok := err.(*exec.ExitError); ok {
-			t.Fatalf("unable to start process: %s, %v, %v, %s", os.Args[0], args, err, err.Stderr)
-		}
-		t.Fatalf("%v", err)
+	// Let it remove the veth pairs.
+	l.Cancel = func() error {
+		return l.Process.Signal(os.Interrupt)
 	}
 
-	if len(ctx.Done()) > 0 {
-		t.Fatalf("%v", ctx.Err())
+	if err := l.Start(); err != nil {
+		t.Fatalf("unable to start process: %s, %v, %v", os.Args[0], args, err)
 	}
+	defer l.Wait()
+	defer cancel(nil)
 
+	// From the host side of the veth pair, once it's there. Before
+	// that the address would be routed elsewhere.
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("10.213.1.1")}}
+	payload := "hello there"
 	retries := 0
 retry:
-	connWrite, err := net.Dial("tcp", addr1)
+	connWrite, err := dialer.Dial("tcp", listenAddr)
 	if err != nil {
-		if retries > 10 {
+		if retries > 50 {
 			t.Fatalf("unable to dial: %v", err)
 		} else {
 			retries++
@@ -332,6 +403,9 @@ retry:
 		}
 	}
 	defer connWrite.Close()
+	if config != nil {
+		connWrite = tls.Client(connWrite, config)
+	}
 
 	_, err = connWrite.Write([]byte(payload))
 	if err != nil {
@@ -340,18 +414,76 @@ retry:
 
 	select {
 	case <-ctx.Done():
-		t.Fatalf("%v", ctx.Err())
+		t.Fatalf("%v", context.Cause(ctx))
 	case conn := <-connCh:
 		defer conn.Close()
 		buf := make([]byte, len(payload))
-		_, err := conn.Read(buf)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.ReadFull(conn, buf)
 		if err != nil {
 			t.Fatalf("%v", err)
 		}
 		if string(buf) != payload {
 			t.Fatalf("payload not received")
 		}
-		l.Cancel()
 	}
-	fmt.Printf("hey: %v\n", l.Wait())
+}
+
+// TestForkListenForkClientHeld kills the listening child, a connection
+// made before it's restarted waits on the listener held by the parent.
+// The client child may be seen exiting first, it restarts both too.
+func TestForkListenForkClientHeld(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer backend.Close()
+	go echo(backend)
+
+	addr, socket := freeAddr(t), filepath.Join(t.TempDir(), "admin.sock")
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestE2EBin$", "-test.timeout", "20s", "--",
+		"--admin.socket="+socket, "--listen.addr="+addr, "--client.addr="+backend.Addr().String(),
+		"--listen.fork", "--listen.restart=always", "--listen.restart.backoff=500ms",
+		"--client.fork", "--client.restart=always", "--client.restart.backoff=500ms", "--drain-timeout=1s")
+	cmd.Env = []string{"CMD_TEST_E2E=1"}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Signal(os.Interrupt)
+
+	if err := roundTrip(addr, "before"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp := adminRequest(t, socket, &AdminRequest{Command: "ls"})
+	if len(resp.Connections) != 1 || len(resp.Connections[0].Pids) != 2 {
+		t.Fatalf("unexpected ls response: %+v", resp)
+	}
+	listenPid := resp.Connections[0].Pids[0]
+	if err := syscall.Kill(listenPid, syscall.SIGKILL); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for syscall.Kill(listenPid, 0) == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Not retried, there is nothing listening but the held copy.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	payload := "meanwhile"
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(buf) != payload {
+		t.Fatalf("got %q", buf)
+	}
 }
@@ -1,92 +1,370 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"os/exec"
+	"golang.org/x/sys/unix"
 )
 
 type ForkListenProxy struct {
 	*Proc
-	Cmd *exec.Cmd
+	Cmd *Child
+
+	mu         sync.Mutex
+	restarting sync.Mutex
+	uc         *net.UnixConn
+	listener   chan *os.File
+	held       *os.File
+	draining   atomic.Bool
+	l          *Listen
+	c          *Client
+	errCh      chan error
+	supervisor *Supervisor
 }
 
-func (f *ForkListenProxy) listen(l *Listen) (net.Listener, error) {
-	args := []string{fmt.Sprintf("--listen.addr=%s", l.GetAddr()), "--client.addr=FD:3"}
-	args = append(args, l.TLS.Args("listen.tls")...)
+func (f *ForkListenProxy) listen(l *Listen) (*Child, *net.UnixConn, net.Listener, error) {
+	cfg := &ChildConfig{Role: "listen", Listen: l, Client: f.c, DrainTimeout: l.drainTimeout}
+	f.mu.Lock()
+	inherited := l.inherited
+	l.inherited = nil
+	f.mu.Unlock()
+	if inherited != nil {
+		// Let the child accept on the listener we were handed.
+		defer inherited.Close()
+	}
 
-	cmd, uc, err := ForkUnixConn(l.Ctx, l.User, &l.NetNs, os.Args[0], args...)
+	cmd, uc, err := ForkChild(l.Ctx, l.Proc, l.User, &l.NetNs, cfg, inherited)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	f.Cmd = cmd
-	return &UnixConnListener{uc}, nil
+	return cmd, uc, &UnixConnListener{UnixConn: uc, OnListener: f.onListener}, nil
 }
 
-func (f *ForkListenProxy) dial(c *Client) (conn net.Conn, err error) {
-	return (&Dialer{
-		NetNs:     &c.NetNs,
-		Timeout:   c.Timeout,
-		TLSConfig: c.TLS.config,
-		SourceIP:  c.SourceIP,
-	}).DialContext(c.Ctx, c.Protocol, c.GetAddr())
-}
+// start forks a listening child and makes it the current one, the
+// previous child is returned.
+func (f *ForkListenProxy) start() (old *Child, oldUc *net.UnixConn, err error) {
+	cmd, uc, ln, err := f.listen(f.l)
+	if err != nil {
+		return nil, nil, err
+	}
 
-func (f *ForkListenProxy) Close() error {
-	return nil
+	f.mu.Lock()
+	old, oldUc = f.Cmd, f.uc
+	f.Cmd, f.uc = cmd, uc
+	f.mu.Unlock()
+
+	go f.wait(cmd)
+	go f.serve(cmd, ln)
+	if f.supervisor.Policy != "never" {
+		go f.hold(cmd)
+	}
+	return old, oldUc, nil
 }
 
-func (f *ForkListenProxy) Proxy(l *Listen, c *Client) (err error) {
-	var ln net.Listener
-	ln, err = f.listen(l)
+// hold keeps a copy of the listener of cmd, a child started after cmd
+// has crashed accepts on it. Connections wait in its backlog meanwhile.
+func (f *ForkListenProxy) hold(cmd *Child) {
+	file, err := f.Listener()
 	if err != nil {
+		fmt.Printf("Warning: %s: %v, it's bound again on restart\n", f.l.GetAddr(), err)
+		return
+	}
+	f.mu.Lock()
+	if f.Cmd != cmd {
+		f.mu.Unlock()
+		file.Close()
 		return
 	}
-	defer f.Cmd.Cancel()
+	old := f.held
+	f.held = file
+	f.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
 
-	// Make sure ln is closed if cmd exits
-	go func() {
-		if err := f.Cmd.Wait(); err != nil {
-			if err, ok := err.(*exec.ExitError); ok {
-				fmt.Printf("unable to start process: %v, %s", err, err.Stderr)
-			}
-			fmt.Printf("unable to start process: %v", err)
-			os.Exit(1)
+// release closes the copy of the listener, once nothing accepts on it
+// anymore it should refuse connections.
+func (f *ForkListenProxy) release() {
+	f.mu.Lock()
+	held := f.held
+	f.held = nil
+	f.mu.Unlock()
+	if held != nil {
+		held.Close()
+	}
+}
+
+func (f *ForkListenProxy) done(err error) {
+	select {
+	case f.errCh <- err:
+	default:
+	}
+}
+
+func (f *ForkListenProxy) current(cmd *Child) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Cmd == cmd
+}
+
+// wait restarts the current child when it exits, if its supervisor
+// says so. Otherwise Proxy returns.
+func (f *ForkListenProxy) wait(cmd *Child) {
+	started := time.Now()
+	err := cmd.Wait()
+	// A replaced child is drained by replace.
+	if !f.current(cmd) {
+		return
+	}
+	if f.draining.Load() {
+		f.done(nil)
+		return
+	}
+
+	err = exitError(err)
+	delay, restart, serr := f.supervisor.Next(err, time.Since(started), time.Now())
+	if !restart {
+		f.done(serr)
+		return
+	}
+	fmt.Printf("Error: %s: listening child %d exited: %v, restarting in %s\n", f.l.GetAddr(), cmd.Pid(), err, delay)
+	if !sleepContext(f.l.Ctx, delay) {
+		f.done(f.l.Ctx.Err())
+		return
+	}
+	f.restarting.Lock()
+	defer f.restarting.Unlock()
+	// Restarted or drained meanwhile.
+	if !f.current(cmd) || f.draining.Load() {
+		return
+	}
+
+	f.mu.Lock()
+	if f.held != nil {
+		if f.l.inherited, err = dupFile(f.held); err != nil {
+			fmt.Printf("Error: %s: %v\n", f.l.GetAddr(), err)
 		}
-		os.Exit(0)
-	}()
+	}
+	f.mu.Unlock()
+	_, oldUc, err := f.start()
+	if err != nil {
+		f.done(err)
+		return
+	}
+	oldUc.Close()
+}
 
-	var src, dst net.Conn
+func (f *ForkListenProxy) serve(cmd *Child, ln net.Listener) {
 	for {
-		if src, err = ln.Accept(); err != nil {
+		src, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, ErrDraining) {
+				f.draining.Store(true)
+			}
+			// The channel to the child is gone, wait decides what's
+			// next once it has exited.
 			return
 		}
+		if pc, ok := src.(*PeerConn); ok && f.l.Debug {
+			fmt.Printf("%s -> %s\n", &pc.Meta, f.c.GetAddr())
+		}
 
 		go func() {
-			src = &CloseWriter{src}
 			defer func() {
-				if err := src.Close(); err != nil {
+				if err := (&CloseWriter{src}).Close(); err != nil {
 					fmt.Printf("unable to close: %v\n", err)
 				}
 			}()
-			if dst, err = f.dial(c); err != nil {
+			dst, err := f.dial(f.c)
+			if err != nil {
 				fmt.Printf("unable to dial: %v\n", err)
 				return
 			}
-			go func() {
-				defer func() {
-					cw := &CloseWriter{dst}
-					if err := cw.Close(); err != nil {
-						fmt.Printf("unable to close: %v\n", err)
-					}
-				}()
-				io.Copy(dst, src)
-			}()
-			io.Copy(src, dst)
+			f.l.conns.Pipe(0, src, dst)
 		}()
 	}
 }
+
+func (f *ForkListenProxy) onListener(file *os.File) {
+	offerListener(f.listener, file)
+}
+
+// offerListener gives a listener sent back by a listening child to the
+// one waiting for it in askListener.
+func offerListener(listener chan *os.File, file *os.File) {
+	select {
+	case listener <- file:
+	default:
+		if file != nil {
+			file.Close()
+		}
+	}
+}
+
+// Listener asks the listening child for a copy of its listener.
+func (f *ForkListenProxy) Listener() (*os.File, error) {
+	f.mu.Lock()
+	cmd, uc := f.Cmd, f.uc
+	f.mu.Unlock()
+	return askListener(cmd, uc, f.listener)
+}
+
+// askListener asks the listening child cmd over uc to send back its
+// listener, it's read from uc and handed to listener.
+func askListener(cmd *Child, uc *net.UnixConn, listener chan *os.File) (*os.File, error) {
+	if uc == nil {
+		return nil, fmt.Errorf("no listening child")
+	}
+	if err := WriteMsgConn(uc, &Msg{Type: MsgListener}); err != nil {
+		return nil, err
+	}
+	select {
+	case file := <-listener:
+		if file == nil {
+			return nil, fmt.Errorf("listening child %d has no listener to hand over", cmd.Pid())
+		}
+		return file, nil
+	case <-time.After(5 * time.Second):
+		return nil, fmt.Errorf("listening child %d did not hand over its listener", cmd.Pid())
+	}
+}
+
+// Reload asks the listening child to read its certificates again.
+func (f *ForkListenProxy) Reload() error {
+	f.mu.Lock()
+	uc := f.uc
+	f.mu.Unlock()
+	if uc == nil {
+		return fmt.Errorf("no listening child")
+	}
+	return WriteMsgConn(uc, &Msg{Type: MsgReload})
+}
+
+// Restart replaces the listening child, the new child accepts on the
+// listener of the old one.
+func (f *ForkListenProxy) Restart() error {
+	file, err := f.Listener()
+	if err != nil {
+		return err
+	}
+	return f.replace(file)
+}
+
+// Rebind replaces the listening child with one that listens again,
+// e.g. in a namespace that has changed.
+func (f *ForkListenProxy) Rebind() error {
+	return f.replace(nil)
+}
+
+// replace starts a new listening child, on inherited if it's set, and
+// drains the current one. wait doesn't restart a child meanwhile.
+func (f *ForkListenProxy) replace(inherited *os.File) error {
+	f.restarting.Lock()
+	defer f.restarting.Unlock()
+	if f.current(nil) {
+		if inherited != nil {
+			inherited.Close()
+		}
+		return fmt.Errorf("not started")
+	}
+	f.mu.Lock()
+	f.l.inherited = inherited
+	f.mu.Unlock()
+	old, oldUc, err := f.start()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := old.Drain(oldUc, f.l.drainTimeout); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		oldUc.Close()
+	}()
+	return nil
+}
+
+func (f *ForkListenProxy) dial(c *Client) (conn net.Conn, err error) {
+	return (&Dialer{
+		NetNs:     &c.NetNs,
+		Timeout:   c.Timeout,
+		TLSConfig: c.TLS.config,
+		SourceIP:  c.SourceIP,
+	}).DialContext(c.Ctx, c.Protocol, c.GetAddr())
+}
+
+func (f *ForkListenProxy) Close() error {
+	return nil
+}
+
+// dupFile copies file without Fd, which would make the socket blocking
+// for the child accepting on it too.
+func dupFile(file *os.File) (*os.File, error) {
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	fd := -1
+	if err := rc.Control(func(f uintptr) {
+		fd, err = unix.FcntlInt(f, unix.F_DUPFD_CLOEXEC, 0)
+	}); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dup %s: %v", file.Name(), err)
+	}
+	return os.NewFile(uintptr(fd), file.Name()), nil
+}
+
+// Drain asks the listening child to stop accepting and waits for it.
+func (f *ForkListenProxy) Drain(timeout time.Duration) error {
+	f.mu.Lock()
+	cmd, uc := f.Cmd, f.uc
+	f.mu.Unlock()
+	if cmd == nil {
+		return nil
+	}
+	f.release()
+	var via OSFile
+	if !f.draining.Swap(true) {
+		via = uc
+	}
+	return cmd.Drain(via, timeout)
+}
+
+func (f *ForkListenProxy) Pids() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Cmd.Pid() == 0 {
+		return nil
+	}
+	return []int{f.Cmd.Pid()}
+}
+
+func (f *ForkListenProxy) Proxy(l *Listen, c *Client) (err error) {
+	f.l, f.c, f.supervisor = l, c, l.Proc.supervisor()
+	f.listener, f.errCh = make(chan *os.File, 1), make(chan error, 1)
+	if _, _, err = f.start(); err != nil {
+		return
+	}
+	defer func() {
+		f.release()
+		// Drain takes care of the child.
+		if f.draining.Load() {
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.Cmd.Cancel()
+	}()
+
+	return <-f.errCh
+}
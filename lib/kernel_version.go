@@ -53,22 +53,26 @@ func NewKernelVersion() (*KernelVersion, error) {
 		return nil, fmt.Errorf("unable to parse minor version: %s", parts[1])
 	}
 
-	dot, err := strconv.Atoi(parts[1])
+	// The last part has the local version too, 44-fc-v139.
+	dot := parts[2]
+	if i := strings.IndexFunc(dot, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		dot = dot[:i]
+	}
+	dotInt, err := strconv.Atoi(dot)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse minor version: %s", parts[1])
+		return nil, fmt.Errorf("unable to parse dot version: %s", parts[2])
 	}
 
-	return &KernelVersion{Major: major, Minor: minor, Dot: dot}, nil
+	return &KernelVersion{Major: major, Minor: minor, Dot: dotInt}, nil
 }
 
+// Ok tells if version is at least k.
 func (k *KernelVersion) Ok(version KernelVersion) bool {
-	if version.Major < k.Major {
-		return true
-	} else if version.Major == k.Major && version.Minor < k.Minor {
-		return true
-	} else if version.Major == k.Major && version.Minor == k.Minor && version.Dot <= k.Dot {
-		return true
+	if version.Major != k.Major {
+		return version.Major > k.Major
 	}
-
-	return false
+	if version.Minor != k.Minor {
+		return version.Minor > k.Minor
+	}
+	return version.Dot >= k.Dot
 }
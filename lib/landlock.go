@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/psx"
+)
+
+var landlockKernelVersion = KernelVersion{5, 13, 0}
+
+// landlockCAFiles are where the system CA bundles are, a client
+// without --client.tls.ca-file loads one at its first handshake.
+var landlockCAFiles = []string{
+	"/etc/ssl/certs",
+	"/etc/ssl/cert.pem",
+	"/etc/pki/tls",
+	"/etc/pki/ca-trust",
+	"/etc/ca-certificates",
+	"/usr/share/ca-certificates",
+	"/usr/local/share/certs",
+}
+
+// landlockSystemFiles are read while resolving and listening, and to
+// know what the kernel supports.
+var landlockSystemFiles = []string{
+	"/etc/resolv.conf",
+	"/etc/hosts",
+	"/etc/nsswitch.conf",
+	"/etc/host.conf",
+	"/etc/gai.conf",
+	"/proc/sys/net/core/somaxconn",
+	"/proc/sys/kernel/cap_last_cap",
+	"/proc/version",
+}
+
+// landlockAccess returns the filesystem access rights known to abi,
+// every one of them is handled and so denied unless a rule allows it.
+func landlockAccess(abi int) uint64 {
+	access := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	return access
+}
+
+// childPaths returns the paths a forked child of c still reads, and
+// the directories it creates unix sockets in.
+func (c *Connection) childPaths() (read []string, sockets []string) {
+	for _, t := range []*ClientTLS{c.Listen.TLS.ClientTLS, &c.Client.TLS} {
+		if t == nil {
+			continue
+		}
+		read = append(read, t.CAFiles...)
+		for _, f := range []string{t.CertFile, t.KeyFile} {
+			if f != "" {
+				read = append(read, f)
+			}
+		}
+	}
+	read = append(read, landlockCAFiles...)
+	if f := os.Getenv("SSL_CERT_FILE"); f != "" {
+		read = append(read, f)
+	}
+	if d := os.Getenv("SSL_CERT_DIR"); d != "" {
+		read = append(read, filepath.SplitList(d)...)
+	}
+	read = append(read, landlockSystemFiles...)
+
+	if c.Listen.Protocol == "unix" && !c.Listen.IsFd() && c.Listen.inherited == nil {
+		sockets = append(sockets, filepath.Dir(c.Listen.GetAddr()))
+	}
+	return
+}
+
+// restrictFiles takes away access to all files but read to those in
+// read, and creating and removing unix sockets in sockets. Paths that
+// don't exist are skipped. It's for the whole process and can't be
+// undone. Without Landlock in the kernel nothing is restricted.
+func restrictFiles(read, sockets []string) error {
+	// In a chroot without /proc asking Landlock itself has to do.
+	kernel, err := NewKernelVersion()
+	if err == nil && !landlockKernelVersion.Ok(*kernel) {
+		fmt.Printf("Warning: landlock needs Linux %d.%d, running %d.%d, files are not restricted\n",
+			landlockKernelVersion.Major, landlockKernelVersion.Minor, kernel.Major, kernel.Minor)
+		return nil
+	}
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		// Built without it or not enabled at boot.
+		fmt.Printf("Warning: landlock: %v, files are not restricted\n", errno)
+		return nil
+	}
+
+	handled := landlockAccess(int(abi))
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: create ruleset: %v", errno)
+	}
+	ruleset := int(fd)
+	defer unix.Close(ruleset)
+
+	add := func(path string, access uint64) error {
+		f, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err == unix.ENOENT {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("landlock: %s: %v", path, err)
+		}
+		defer unix.Close(f)
+
+		var st unix.Stat_t
+		if err := unix.Fstat(f, &st); err != nil {
+			return fmt.Errorf("landlock: %s: %v", path, err)
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			// Only file rights can be given on a file.
+			access &= unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE |
+				unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+		}
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: access & handled, Parent_fd: int32(f)}
+		if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH,
+			uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+			return fmt.Errorf("landlock: %s: %v", path, errno)
+		}
+		return nil
+	}
+	for _, path := range read {
+		if err := add(path, unix.LANDLOCK_ACCESS_FS_READ_FILE|unix.LANDLOCK_ACCESS_FS_READ_DIR); err != nil {
+			return err
+		}
+	}
+	for _, path := range sockets {
+		if err := add(path, unix.LANDLOCK_ACCESS_FS_MAKE_SOCK|unix.LANDLOCK_ACCESS_FS_REMOVE_FILE); err != nil {
+			return err
+		}
+	}
+
+	// Both only apply to the thread that calls them, psx calls them
+	// on all threads of the process.
+	if err := setNoNewPrivs(); err != nil {
+		return fmt.Errorf("landlock: %v", err)
+	}
+	if _, _, errno := psx.Syscall3(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("landlock: restrict: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRestrictFiles(t *testing.T) {
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION); errno != 0 {
+		t.Skipf("landlock: %v", errno)
+	}
+
+	// Restricting can't be undone, it's done in a copy of the test.
+	if dir := os.Getenv("GOPIPE_TEST_LANDLOCK"); dir != "" {
+		allowed, denied := filepath.Join(dir, "allowed"), filepath.Join(dir, "denied")
+		if err := restrictFiles([]string{allowed}, nil); err != nil {
+			t.Fatalf("%v", err)
+		}
+		// Every thread is restricted, not only the one that asked.
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := os.ReadFile(allowed); err != nil {
+					t.Errorf("%v", err)
+				}
+				if _, err := os.ReadFile(denied); !errors.Is(err, os.ErrPermission) {
+					t.Errorf("read %s: %v", denied, err)
+				}
+				if err := os.WriteFile(allowed, nil, 0600); !errors.Is(err, os.ErrPermission) {
+					t.Errorf("write %s: %v", allowed, err)
+				}
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	dir := t.TempDir()
+	for _, f := range []string{"allowed", "denied"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(f), 0600); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestrictFiles$")
+	cmd.Env = append(os.Environ(), "GOPIPE_TEST_LANDLOCK="+dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
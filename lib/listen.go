@@ -2,23 +2,74 @@ package lib
 
 import (
 	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"time"
 )
 
 type Listen struct {
 	*Addr
 	*User
-	*Proc
+	*Proc    `json:"-"`
 	Debug    bool             `long:"debug"`
 	TLS      ListenTLS        `group:"tls" namespace:"tls"`
-	NetNs    NetworkNamespace `group:"netns" namespace:"netns"`
+	NetNs    NetworkNamespace `group:"netns" namespace:"netns" json:"-"`
 	Protocol string           `long:"protocol" default:"tcp" choice:"unix" choice:"unixgram" choice:"udp" choice:"tcp" description:"The protocol to connect with"`
 
-	IncomingConn bool `long:"conn" description:"Accept conns from parent"`
+	// Set for a forked child that is passed connections by its parent,
+	// and reports how many are active back.
+	IncomingConn bool
+	ReportActive bool
 
-	Ctx    context.Context
+	Ctx    context.Context `json:"-"`
 	client *Client
+	conns  *Tracker
+
+	// ln is the listening socket before any TLS, inherited is one
+	// handed over by the process we are upgrading from.
+	ln        net.Listener
+	inherited *os.File
+	// control is the channel to the parent of a forked child that
+	// passes connections on over another one.
+	control int
+
+	drainTimeout time.Duration
+	shutdown     func(time.Duration)
 }
 
 func (l *Listen) SetClient(client *Client) {
 	l.client = client
 }
+
+func (l *Listen) Listener() (ln net.Listener, err error) {
+	switch {
+	case l.inherited != nil:
+		ln, err = net.FileListener(l.inherited)
+		l.inherited.Close()
+		l.inherited = nil
+	case l.IsFd():
+		ln, err = l.GetListener(nil)
+	default:
+		ln, err = net.Listen(l.Protocol, l.GetAddr())
+	}
+	if err != nil {
+		return
+	}
+	l.ln = ln
+
+	if l.TLS.config != nil {
+		ln = tls.NewListener(ln, l.TLS.config)
+	}
+
+	return
+}
+
+// ListenerFile returns a copy of the listening socket.
+func (l *Listen) ListenerFile() (*os.File, error) {
+	f, ok := l.ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errNoListener
+	}
+	return f.File()
+}
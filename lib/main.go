@@ -2,10 +2,15 @@ package lib
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/coreos/go-systemd/v22/daemon"
 	"github.com/jessevdk/go-flags"
 
 	"golang.org/x/sync/errgroup"
@@ -16,12 +21,178 @@ type Connection struct {
 
 	Client Client `group:"client" namespace:"client"`
 
-	proxy Proxy
+	Admin Admin `group:"admin" namespace:"admin"`
+
+	Name           string        `long:"name" description:"Name used to refer to the connection"`
+	DrainTimeout   time.Duration `long:"drain-timeout" default:"10s" description:"Time given to open connections to finish on shutdown"`
+	UpgradeTimeout time.Duration `long:"upgrade-timeout" default:"10s" description:"Time given to a new process to take over on upgrade"`
+	ExitOnIdle     time.Duration `long:"exit-on-idle" description:"Exit once no connections have been active for this long"`
+	Child          int           `long:"child" hidden:"true" description:"Set by the parent, a forked child is configured over this fd"`
+	Mode           string
+
+	// What a forked child sets up, sent by the parent.
+	ChildSandbox
+
+	proxy   Proxy
+	tracker *Tracker
 
 	Debug bool `long:"debug"`
 }
 
+func (c *Connection) Status(id int) ConnectionStatus {
+	s := ConnectionStatus{
+		ID:          id,
+		Name:        c.Name,
+		Mode:        c.Mode,
+		Listen:      c.Listen.GetAddr(),
+		Client:      c.Client.GetAddr(),
+		ListenNetNs: c.Listen.NetNs.String(),
+		ClientNetNs: c.Client.NetNs.String(),
+		Active:      c.tracker.Active(),
+	}
+	s.Accepted, s.BytesIn, s.BytesOut = c.tracker.Totals()
+	if p, ok := c.proxy.(Pider); ok {
+		s.Pids = p.Pids()
+	}
+	for _, pid := range s.Pids {
+		if u, ok := childCGroupUsage(pid); ok {
+			s.CGroups = append(s.CGroups, u)
+		}
+	}
+	return s
+}
+
+// listenNetNsChanged moves a forked listener into the new namespace,
+// listeners in this process don't live in the listen namespace.
+func (c *Connection) listenNetNsChanged() {
+	if !c.Listen.ShouldFork {
+		return
+	}
+	fmt.Printf("%s: listen namespace changed to %s\n", c.Name, c.Listen.NetNs.String())
+	r, ok := c.proxy.(Rebinder)
+	if !ok {
+		fmt.Printf("Error: %s: rebind not supported by %s\n", c.Name, c.Mode)
+		return
+	}
+	if err := r.Rebind(); err != nil {
+		fmt.Printf("Error: %s: rebind: %v\n", c.Name, err)
+	}
+}
+
+// clientNetNsChanged replaces a forked client, dials from this process
+// use the new namespace right away.
+func (c *Connection) clientNetNsChanged() {
+	if !c.Client.ShouldFork {
+		return
+	}
+	fmt.Printf("%s: client namespace changed to %s\n", c.Name, c.Client.NetNs.String())
+	r, ok := c.proxy.(Restarter)
+	if !ok {
+		fmt.Printf("Error: %s: restart not supported by %s\n", c.Name, c.Mode)
+		return
+	}
+	if err := r.Restart(); err != nil {
+		fmt.Printf("Error: %s: restart: %v\n", c.Name, err)
+	}
+}
+
+// waitNetNs blocks until the namespaces of both sides exist, systemd
+// is kept up to date through STATUS.
+func (c *Connection) waitNetNs() error {
+	waited := false
+	status := func(s string) {
+		if !waited || c.Debug {
+			fmt.Printf("%s: %s\n", c.Name, s)
+		}
+		waited = true
+		daemon.SdNotify(false, fmt.Sprintf("STATUS=%s: %s", c.Name, s))
+	}
+
+	for _, n := range []*NetworkNamespace{&c.Listen.NetNs, &c.Client.NetNs} {
+		if err := n.WaitFor(status); err != nil {
+			return err
+		}
+	}
+
+	if waited {
+		fmt.Printf("%s: namespaces found, listening on %s\n", c.Name, c.Listen.GetAddr())
+		daemon.SdNotify(false, fmt.Sprintf("STATUS=%s: listening on %s", c.Name, c.Listen.GetAddr()))
+	}
+	return nil
+}
+
+// Shutdown stops accepting new connections and waits up to timeout for
+// open connections and forked children to finish before closing them.
+func (c *Connection) Shutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := c.proxy.(Drainer); ok {
+		if err := d.Drain(timeout); err != nil {
+			fmt.Printf("Error: %s: drain: %v\n", c.Name, err)
+		}
+	}
+	if !c.tracker.Wait(deadline) {
+		fmt.Printf("Error: %s: closing %d connections after drain timeout\n", c.Name, c.tracker.Active())
+	}
+	c.tracker.CloseAll()
+}
+
+// exitOnIdle shuts down once no connection has been active for idle,
+// systemd keeps the listening socket and starts us again when needed.
+func exitOnIdle(ctx context.Context, connections []*Connection, idle time.Duration, shutdown func(time.Duration)) {
+	interval := time.Second
+	if idle < 10*interval {
+		interval = max(idle/10, time.Millisecond)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		busy := false
+		for _, k := range connections {
+			if k.tracker.Idle() < idle {
+				busy = true
+				break
+			}
+		}
+		if busy {
+			continue
+		}
+
+		if _, err := daemon.SdNotify(false, daemon.SdNotifyStopping); err != nil {
+			fmt.Printf("Error: sd_notify: %v\n", err)
+		}
+		shutdown(-1)
+		return
+	}
+}
+
+// checkGroups rejects options that are for the whole process when they
+// are given after the first --next, or that don't work with a
+// connection.
+func checkGroups(connections []*Connection) error {
+	for _, k := range connections[1:] {
+		if k.ExitOnIdle != 0 {
+			return fmt.Errorf("%s: --exit-on-idle is for all connections, give it before the first --next", k.Name)
+		}
+	}
+	for _, k := range connections {
+		// The listening child passes connections straight to the
+		// client child, we never see them.
+		if connections[0].ExitOnIdle > 0 && k.Listen.ShouldFork && k.Client.ShouldFork {
+			return fmt.Errorf("%s: --exit-on-idle is not supported with --listen.fork and --client.fork", k.Name)
+		}
+	}
+	return nil
+}
+
 func MainFunc(args []string) {
+	closeNsenterFds()
 
 	connections := []*Connection{}
 
@@ -48,29 +219,104 @@ func MainFunc(args []string) {
 
 			panic(err)
 		}
+		if connection.Child > 0 {
+			if err := connection.readChildConfig(); err != nil {
+				connection.fail("config", err)
+			}
+		}
 		if connection.Listen.ShouldFork && connection.Client.ShouldFork {
-			connection.proxy = &ForkListenForkClientProxy{}
+			connection.proxy, connection.Mode = &ForkListenForkClientProxy{}, "ForkListenForkClient"
 		} else if connection.Listen.ShouldFork {
-			connection.proxy = &ForkListenProxy{}
+			connection.proxy, connection.Mode = &ForkListenProxy{}, "ForkListen"
 		} else if connection.Client.ShouldFork {
-			connection.proxy = &ForkClientProxy{}
+			connection.proxy, connection.Mode = &ForkClientProxy{}, "ForkClient"
 		} else if connection.Client.Addr.IsFd() {
-			connection.proxy = &UnixSendProxy{}
+			connection.proxy, connection.Mode = &UnixSendProxy{}, "UnixSend"
 		} else if connection.Listen.Addr.IsFd() && connection.Listen.IncomingConn {
-			connection.proxy = &UnixDialProxy{}
+			connection.proxy, connection.Mode = &UnixDialProxy{}, "UnixDial"
 		} else {
-			connection.proxy = &SimpleProxy{}
+			connection.proxy, connection.Mode = &SimpleProxy{}, "Simple"
+		}
+		if connection.Name == "" {
+			connection.Name = connection.Listen.GetAddr()
 		}
+		connection.tracker = NewTracker(connection.Name)
+		connection.Listen.conns = connection.tracker
 		connections = append(connections, connection)
 	}
 
+	if err := checkGroups(connections); err != nil {
+		panic(err)
+	}
+
+	upgradeFile, err := inherit(connections)
+	if err != nil {
+		panic(err)
+	}
+
 	bCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
 	cCtx, cancel := context.WithCancelCause(context.Background())
 	g, ctx := errgroup.WithContext(cCtx)
 
+	// A drain message from the parent process shuts down the same way
+	// as an interrupt, but with the timeout it sent.
+	shutdownCh := make(chan time.Duration, 1)
+	shutdown := func(timeout time.Duration) {
+		select {
+		case shutdownCh <- timeout:
+		default:
+		}
+	}
+
+	// Once a new process has taken over we drain like on a drain message.
+	upgrader := &Upgrader{
+		Connections: connections,
+		Timeout:     connections[0].UpgradeTimeout,
+		OnReady:     func() { shutdown(-1) },
+	}
+	usr2 := make(chan os.Signal, 1)
+	if connections[0].Child > 0 {
+		// Forked children are started again by their parent, not
+		// when SIGUSR2 is sent to all of the processes of a unit.
+		signal.Ignore(syscall.SIGUSR2)
+	} else {
+		signal.Notify(usr2, syscall.SIGUSR2)
+		defer signal.Stop(usr2)
+	}
+	go func() {
+		for range usr2 {
+			if err := upgrader.Upgrade(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		}
+	}()
+
 	for _, k := range connections {
+		if k.Admin.Socket == "" {
+			continue
+		}
+		admin := &AdminServer{Admin: &k.Admin, Connections: connections, Upgrade: upgrader.Upgrade}
+		if err := admin.Listen(); err != nil {
+			panic(err)
+		}
+		// The socket belongs to the new process after an upgrade.
+		defer func(socket string) {
+			if !upgrader.Upgraded() {
+				os.Remove(socket)
+			}
+		}(k.Admin.Socket)
+		go func() {
+			if err := admin.Serve(ctx); err != nil {
+				fmt.Printf("Error: admin: %v\n", err)
+			}
+		}()
+		break
+	}
+
+	for _, k := range connections {
+		k := k
 		if k.Debug {
 			fmt.Printf("Found: %s(%s) -> %s(%s)\n",
 				k.Listen.Addr,
@@ -80,6 +326,9 @@ func MainFunc(args []string) {
 			)
 		}
 		k.Listen.Ctx = ctx
+		k.Listen.shutdown = shutdown
+		k.Listen.drainTimeout = k.DrainTimeout
+		k.Client.drainTimeout = k.DrainTimeout
 		k.Listen.NetNs.Ctx = ctx
 		if !k.Listen.NetNs.Disable {
 			k.Listen.NetNs.SetCurrent()
@@ -92,6 +341,13 @@ func MainFunc(args []string) {
 		}
 		k.Client.NetNs.Protocol = k.Listen.Protocol
 
+		if err := k.Listen.NetNs.Follow(k.listenNetNsChanged); err != nil {
+			fmt.Printf("Error: %s: follow %s: %v\n", k.Name, k.Listen.NetNs.SystemdUnit, err)
+		}
+		if err := k.Client.NetNs.Follow(k.clientNetNsChanged); err != nil {
+			fmt.Printf("Error: %s: follow %s: %v\n", k.Name, k.Client.NetNs.SystemdUnit, err)
+		}
+
 		if k.Debug {
 			k.Listen.Debug = true
 			k.Client.Debug = true
@@ -107,48 +363,112 @@ func MainFunc(args []string) {
 			k.Client.TLS.Debug = true
 		}
 
+		// The certificates are loaded from inside the new root.
+		if err := k.enterRoot(); err != nil {
+			k.fail("root", err)
+		}
+
 		if err := k.Listen.TLS.TLSConfig(); err != nil {
-			panic(err)
+			k.fail("listen tls", err)
 		}
 
 		if err := k.Client.TLS.TLSConfig(); err != nil {
-			panic(err)
+			k.fail("client tls", err)
+		}
+
+		// Certificates are loaded, the rest is accepting or dialing
+		// and moving bytes.
+		if k.DropCaps {
+			caps, err := parseCaps(k.Caps)
+			if err != nil {
+				k.fail("caps", err)
+			}
+			if err := dropCaps(caps); err != nil {
+				k.fail("caps", err)
+			}
+		}
+		if k.NoNewPrivs {
+			if err := setNoNewPrivs(); err != nil {
+				k.fail("no-new-privs", err)
+			}
+		}
+		if k.Landlock {
+			if err := restrictFiles(k.childPaths()); err != nil {
+				k.fail("landlock", err)
+			}
+		}
+		if k.Seccomp != "" {
+			role, err := k.seccompRole()
+			if err != nil {
+				k.fail("seccomp", err)
+			}
+			policy, err := seccompPolicy(k.Seccomp, role, k.SeccompProfile)
+			if err != nil {
+				k.fail("seccomp", err)
+			}
+			if err := loadSeccomp(policy); err != nil {
+				k.fail("seccomp", err)
+			}
+		}
+		if k.Child > 0 {
+			if err := k.childReady("", nil); err != nil {
+				panic(err)
+			}
 		}
 		f := func() error {
+			// Listen once the namespaces are there.
+			if err := k.waitNetNs(); err != nil {
+				return err
+			}
 			err := k.proxy.Proxy(&k.Listen, &k.Client)
 			if err != nil && k.Debug {
 				fmt.Printf("Error: %s: %v\n", k.Listen.Addr, err)
 			}
 			return err
 		}
+		defer k.Listen.NetNs.Remove()
+		defer k.Client.NetNs.Remove()
 		defer k.proxy.Close()
 
 		g.Go(f)
 	}
-	go func() {
-		if err := g.Wait(); err != nil {
-			cancel(err)
-		}
 
+	if connections[0].ExitOnIdle > 0 {
+		go exitOnIdle(ctx, connections, connections[0].ExitOnIdle, shutdown)
+	}
+
+	if upgradeFile != nil {
+		if err := ready(upgradeFile); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+	go func() {
+		cancel(g.Wait())
 	}()
+
+	timeout := time.Duration(-1)
 	select {
 	case <-ctx.Done():
-		if err := ctx.Err(); err != nil {
-			fmt.Printf("Error: %v", err)
-			cancel(err)
+		if err := context.Cause(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			fmt.Printf("Error: %v\n", err)
 		}
-		return
-
 	case <-bCtx.Done():
-		if err := bCtx.Err(); err != nil {
-			fmt.Printf("Error: %v", err)
-			cancel(err)
-		}
-		return
-	case <-cCtx.Done():
-		if err := cCtx.Err(); err != nil {
-			fmt.Printf("Error: %v", err)
-		}
-		return
+	case timeout = <-shutdownCh:
+	}
+
+	var wg sync.WaitGroup
+	for _, k := range connections {
+		k := k
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if timeout < 0 {
+				k.Shutdown(k.DrainTimeout)
+			} else {
+				k.Shutdown(timeout)
+			}
+		}()
 	}
+	wg.Wait()
+	cancel(nil)
 }
@@ -1,9 +1,11 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 )
 
 // TestE2EBin isn't a real test.
@@ -25,5 +27,37 @@ func TestE2EBin(t *testing.T) {
 		os.Exit(3)
 	}
 
+	// Forked children run this test too.
+	childArgs = []string{"-test.run", "^TestE2EBin$", "-test.timeout", "20s", "--"}
 	MainFunc(args)
 }
+
+func TestCheckGroups(t *testing.T) {
+	connections := []*Connection{{ExitOnIdle: time.Minute}, {Name: "web"}}
+	for _, k := range connections {
+		k.Listen.Proc, k.Client.Proc = &Proc{}, &Proc{}
+	}
+	if err := checkGroups(connections); err != nil {
+		t.Errorf("%v", err)
+	}
+	connections[1].ExitOnIdle = time.Second
+	if err := checkGroups(connections); err == nil {
+		t.Errorf("--exit-on-idle after --next accepted")
+	}
+	connections[1].ExitOnIdle = 0
+	connections[1].Listen.ShouldFork, connections[1].Client.ShouldFork = true, true
+	if err := checkGroups(connections); err == nil {
+		t.Errorf("--exit-on-idle with --listen.fork and --client.fork accepted")
+	}
+}
+
+func TestExitOnIdleShort(t *testing.T) {
+	done := make(chan time.Duration, 1)
+	connections := []*Connection{{Name: "web", tracker: NewTracker("web")}}
+	go exitOnIdle(context.Background(), connections, time.Nanosecond, func(d time.Duration) { done <- d })
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no shutdown after idle")
+	}
+}
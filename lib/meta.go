@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ConnMeta is what the process that accepted a connection knew about
+// it, sent along when the connection is passed to another process.
+// Once TLS is terminated the receiver only sees a socketpair.
+type ConnMeta struct {
+	// ID is the id of the connection in the process that accepted it.
+	ID      uint64 `json:"id"`
+	Network string `json:"network"`
+	Remote  string `json:"remote"`
+	Local   string `json:"local"`
+
+	// ServerName is the SNI the client asked for, PeerSubject and
+	// PeerDNSNames are from its certificate once verified.
+	ServerName   string   `json:"server_name,omitempty"`
+	PeerSubject  string   `json:"peer_subject,omitempty"`
+	PeerDNSNames []string `json:"peer_dns_names,omitempty"`
+}
+
+// NewConnMeta describes conn with the id Tracker.Accepted gave it, a
+// TLS connection has to be done with its handshake for what it
+// negotiated to be there.
+func NewConnMeta(id uint64, conn net.Conn) *ConnMeta {
+	m := &ConnMeta{
+		ID:      id,
+		Network: conn.RemoteAddr().Network(),
+		Remote:  conn.RemoteAddr().String(),
+		Local:   conn.LocalAddr().String(),
+	}
+	if t, ok := conn.(*tls.Conn); ok {
+		state := t.ConnectionState()
+		m.ServerName = state.ServerName
+		if len(state.VerifiedChains) > 0 {
+			cert := state.PeerCertificates[0]
+			m.PeerSubject, m.PeerDNSNames = cert.Subject.String(), cert.DNSNames
+		}
+	}
+	return m
+}
+
+func (m *ConnMeta) String() string {
+	return fmt.Sprintf("%s (%s)", m.Remote, m.details())
+}
+
+// details is what m tells besides the addresses.
+func (m *ConnMeta) details() string {
+	s := []string{fmt.Sprintf("id %d", m.ID)}
+	if m.ServerName != "" {
+		s = append(s, "sni "+m.ServerName)
+	}
+	if m.PeerSubject != "" {
+		s = append(s, "peer "+m.PeerSubject)
+	}
+	return strings.Join(s, ", ")
+}
+
+// PeerConn is a connection passed from another process, its addresses
+// are those that process saw.
+type PeerConn struct {
+	net.Conn
+	Meta ConnMeta
+}
+
+func (c *PeerConn) LocalAddr() net.Addr {
+	return peerAddr{c.Meta.Network, c.Meta.Local}
+}
+
+func (c *PeerConn) RemoteAddr() net.Addr {
+	return peerAddr{c.Meta.Network, c.Meta.Remote}
+}
+
+type peerAddr struct {
+	network string
+	addr    string
+}
+
+func (a peerAddr) Network() string {
+	return a.network
+}
+
+func (a peerAddr) String() string {
+	return a.addr
+}
@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Messages sent over the unix channel between gopipe and its forked
+// children. Every message starts with a type and a payload length,
+// a passed file descriptor is attached to the first byte.
+const (
+	// MsgFd carries a connection, with a JSON ConnMeta as payload
+	// unless the sender knows nothing about it.
+	MsgFd byte = iota + 1
+	// MsgDrain tells the receiver that no more connections are sent
+	// and that it should finish within the duration in the payload.
+	MsgDrain
+	// MsgListener carries a listening socket. Sent without a file it
+	// asks the receiver to pass its listener back.
+	MsgListener
+	// MsgReady ends the listeners handed to an upgraded process and is
+	// sent back once that process has taken over.
+	MsgReady
+	// MsgActive reports the number of active connections back to the
+	// sending side.
+	MsgActive
+	// MsgConfig is the first message to a forked child, a JSON
+	// ChildConfig with a listener attached if it's handed one.
+	MsgConfig
+	// MsgConfigReply is a JSON ChildReply, sent back once the child is
+	// set up or has failed to.
+	MsgConfigReply
+	// MsgReload asks a forked child to read its TLS certificates again,
+	// a listening child passes it on to its client child.
+	MsgReload
+)
+
+const msgHeaderLen = 5
+
+var ErrDraining = errors.New("draining")
+
+type Msg struct {
+	Type    byte
+	Payload []byte
+	File    *os.File
+}
+
+func WriteMsg(fd int, m *Msg) error {
+	buf := make([]byte, msgHeaderLen+len(m.Payload))
+	buf[0] = m.Type
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(m.Payload)))
+	copy(buf[msgHeaderLen:], m.Payload)
+
+	var rights []byte
+	if m.File != nil {
+		// Fd would put the file in blocking mode, which is shared with
+		// our own copy of a passed listener.
+		rc, err := m.File.SyscallConn()
+		if err != nil {
+			return fmt.Errorf("syscallconn: %v", err)
+		}
+		if err := rc.Control(func(fd uintptr) {
+			rights = syscall.UnixRights(int(fd))
+		}); err != nil {
+			return fmt.Errorf("control: %v", err)
+		}
+	}
+
+	n, err := syscall.SendmsgN(fd, buf, rights, nil, 0)
+	if err != nil {
+		return fmt.Errorf("sendmsg: %v", err)
+	}
+
+	for n < len(buf) {
+		m, err := syscall.Write(fd, buf[n:])
+		if err != nil {
+			return fmt.Errorf("write: %v", err)
+		}
+		n += m
+	}
+
+	return nil
+}
+
+func ReadMsg(fd int, filename string) (*Msg, error) {
+	header := make([]byte, msgHeaderLen)
+	oob := make([]byte, syscall.CmsgSpace(4))
+
+	n, oobn, _, _, err := syscall.Recvmsg(fd, header, oob, 0)
+	if err != nil {
+		return nil, fmt.Errorf("recvmsg: %v", err)
+	}
+	if n == 0 && oobn == 0 {
+		return nil, io.EOF
+	}
+
+	m := &Msg{}
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, fmt.Errorf("parsesocketcontrolmessage: %v, %d", err, fd)
+		}
+
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		if err != nil {
+			return nil, fmt.Errorf("parseunixrights: %v", err)
+		}
+		m.File = os.NewFile(uintptr(fds[0]), filename)
+	}
+
+	if err := readFull(fd, header[n:]); err != nil {
+		return nil, err
+	}
+
+	m.Type = header[0]
+	m.Payload = make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if err := readFull(fd, m.Payload); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func readFull(fd int, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := syscall.Read(fd, buf)
+		if err != nil {
+			return fmt.Errorf("read: %v", err)
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+func FdMsg(file *os.File, meta *ConnMeta) (*Msg, error) {
+	m := &Msg{Type: MsgFd, File: file}
+	if meta != nil {
+		payload, err := json.Marshal(meta)
+		if err != nil {
+			return nil, fmt.Errorf("conn meta: %v", err)
+		}
+		m.Payload = payload
+	}
+	return m, nil
+}
+
+// Meta returns what the sender of a passed connection knew about it,
+// nil if it sent nothing.
+func (m *Msg) Meta() (*ConnMeta, error) {
+	if m.Type != MsgFd {
+		return nil, fmt.Errorf("not an fd message: %d", m.Type)
+	}
+	if len(m.Payload) == 0 {
+		return nil, nil
+	}
+	meta := &ConnMeta{}
+	if err := json.Unmarshal(m.Payload, meta); err != nil {
+		return nil, fmt.Errorf("conn meta: %v", err)
+	}
+	return meta, nil
+}
+
+func DrainMsg(timeout time.Duration) *Msg {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(timeout))
+	return &Msg{Type: MsgDrain, Payload: payload}
+}
+
+func (m *Msg) Timeout() (time.Duration, error) {
+	if m.Type != MsgDrain || len(m.Payload) != 8 {
+		return 0, fmt.Errorf("not a drain message: %d", m.Type)
+	}
+	return time.Duration(binary.BigEndian.Uint64(m.Payload)), nil
+}
+
+// WriteMsgConn writes m on the file descriptor behind conn.
+func WriteMsgConn(via OSFile, m *Msg) error {
+	viaf, err := via.File()
+	if err != nil {
+		return fmt.Errorf("file: %v", err)
+	}
+	defer viaf.Close()
+	return WriteMsg(int(viaf.Fd()), m)
+}
+
+func ActiveMsg(n int) *Msg {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(n))
+	return &Msg{Type: MsgActive, Payload: payload}
+}
+
+func (m *Msg) Active() (int, error) {
+	if m.Type != MsgActive || len(m.Payload) != 8 {
+		return 0, fmt.Errorf("not an active message: %d", m.Type)
+	}
+	return int(binary.BigEndian.Uint64(m.Payload)), nil
+}
@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMsgDrain(t *testing.T) {
+	pipe := &Pipe{}
+	conns, err := pipe.Unixpair()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	file, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err := PutFd(pipe.Fds[0], file, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := WriteMsg(pipe.Fds[0], DrainMsg(3*time.Second)); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var drained time.Duration
+	uln := &UnixConnListener{
+		UnixConn: conns[1].(*net.UnixConn),
+		OnDrain:  func(timeout time.Duration) { drained = timeout },
+	}
+
+	src, err := uln.Accept()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	src.Close()
+
+	if _, err := uln.Accept(); !errors.Is(err, ErrDraining) {
+		t.Fatalf("err(%v) != ErrDraining", err)
+	}
+	if drained != 3*time.Second {
+		t.Fatalf("drained(%s) != 3s", drained)
+	}
+}
+
+func TestMsgFdMeta(t *testing.T) {
+	pipe := &Pipe{}
+	conns, err := pipe.Unixpair()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// What the sending side saw is a socketpair to the receiver.
+	plain, err := UnixPipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer plain[0].Close()
+	file, err := plain[1].(*net.UnixConn).File()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	plain[1].Close()
+
+	meta := &ConnMeta{ID: 7, Network: "tcp", Remote: "192.0.2.1:40000", Local: "192.0.2.2:443",
+		ServerName: "example.com", PeerSubject: "CN=client", PeerDNSNames: []string{"client.example.com"}}
+	if err := PutFd(pipe.Fds[0], file, meta); err != nil {
+		t.Fatalf("%v", err)
+	}
+	file.Close()
+
+	uln := &UnixConnListener{UnixConn: conns[1].(*net.UnixConn)}
+	src, err := uln.Accept()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer src.Close()
+	pc, ok := src.(*PeerConn)
+	if !ok {
+		t.Fatalf("no metadata with %T", src)
+	}
+	if pc.RemoteAddr().String() != "192.0.2.1:40000" || pc.LocalAddr().String() != "192.0.2.2:443" {
+		t.Errorf("addresses %s %s", pc.RemoteAddr(), pc.LocalAddr())
+	}
+	if pc.Meta.ID != 7 || pc.Meta.ServerName != "example.com" || pc.Meta.PeerSubject != "CN=client" || len(pc.Meta.PeerDNSNames) != 1 {
+		t.Errorf("meta %+v", pc.Meta)
+	}
+	if s := pc.Meta.String(); s != "192.0.2.1:40000 (id 7, sni example.com, peer CN=client)" {
+		t.Errorf("string %q", s)
+	}
+
+	// Senders without metadata still pass plain connections.
+	if err := WriteMsg(pipe.Fds[0], &Msg{Type: MsgFd, File: pipe.Files[1]}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	src, err = uln.Accept()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer src.Close()
+	if _, ok := src.(*PeerConn); ok {
+		t.Errorf("metadata without payload")
+	}
+}
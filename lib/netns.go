@@ -6,40 +6,109 @@ import (
 	"net"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/coreos/go-systemd/v22/machine1"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
 type NetworkNamespace struct {
-	DockerName  string `long:"docker-name" description:"A docker identifier"`
-	NetName     string `long:"net-name" description:"A iproute2 netns name"`
-	Path        string `long:"path" description:"A netns path"`
-	SystemdUnit string `long:"systemd-unit" description:"A systemd unit name"`
-	PID         int    `long:"pid" description:"Process ID of a running process"`
-	TID         int    `long:"tid" description:"Thread ID of a running thread inside a process"`
-	Disable     bool   `long:"disable" description:"Do not try to use namespaces"`
+	DockerName   string `long:"docker-name" description:"A docker identifier"`
+	PodmanName   string `long:"podman-name" description:"A podman container name or id"`
+	PodmanSocket string `long:"podman-socket" default:"/run/podman/podman.sock" description:"Podman API socket"`
+
+	ContainerdID        string `long:"containerd-id" description:"A containerd container id, the pid of its task is used"`
+	ContainerdNamespace string `long:"containerd-namespace" default:"default" description:"containerd namespace of the container"`
+	ContainerdSocket    string `long:"containerd-socket" default:"/run/containerd/containerd.sock" description:"containerd API socket"`
+
+	CRIPod    string   `long:"cri-pod" description:"A CRI pod sandbox name, or namespace/name"`
+	CRILabel  []string `long:"cri-label" description:"A CRI pod sandbox label, key=value"`
+	CRISocket string   `long:"cri-socket" default:"/run/containerd/containerd.sock" description:"CRI runtime socket"`
+
+	NetName      string `long:"net-name" description:"A iproute2 netns name"`
+	Path         string `long:"path" description:"A netns path"`
+	SystemdUnit  string `long:"systemd-unit" description:"A systemd unit name"`
+	Machine      string `long:"machine" description:"A systemd-machined machine name, e.g. a systemd-nspawn container"`
+	SystemdScope string `long:"systemd-scope" description:"A systemd scope or slice, a process in its cgroup is used"`
+	CGroup       string `long:"cgroup" description:"A cgroup path, a process in it is used"`
+	PID          int    `long:"pid" description:"Process ID of a running process"`
+	TID          int    `long:"tid" description:"Thread ID of a running thread inside a process"`
+	Disable      bool   `long:"disable" description:"Do not try to use namespaces"`
+
+	UserNS  bool `long:"userns" description:"Join the user namespace of the process too, for rootless containers, needs fork"`
+	MountNS bool `long:"mountns" description:"Join the mount namespace of the process too, needs fork"`
+
+	Create bool   `long:"create" description:"Create a new namespace, named by net-name if set, it's removed on exit"`
+	Veth   string `long:"veth" description:"Connect a created namespace with a veth pair, host-cidr,ns-cidr"`
+
+	Wait time.Duration `long:"wait" description:"Wait this long for the namespace to appear"`
 
 	Protocol         string
 	MainPID          int
 	Ctx              context.Context
+	mu               sync.Mutex
 	previousNsHandle netns.NsHandle
 	nsHandle         netns.NsHandle
 	switched         bool
 	lookedup         bool
 	armed            bool
+	created          *ephemeralNetNs
 	Debug            bool `long:"debug"`
 }
 
 func (n *NetworkNamespace) IsSet() bool {
-	if n.DockerName != "" || n.NetName != "" || n.Path != "" || n.SystemdUnit != "" || n.PID > 0 || n.TID > 0 {
+	if n.Create || n.DockerName != "" || n.PodmanName != "" || n.ContainerdID != "" || n.CRIPod != "" || len(n.CRILabel) > 0 || n.NetName != "" || n.Path != "" || n.SystemdUnit != "" || n.Machine != "" || n.SystemdScope != "" || n.CGroup != "" || n.PID > 0 || n.TID > 0 {
 		return true
 	}
 	return false
 }
 
+func (n *NetworkNamespace) String() string {
+	var s string
+	switch {
+	case n.Disable:
+		return "disabled"
+	case n.Create && n.NetName != "":
+		s = fmt.Sprintf("create=%s", n.NetName)
+	case n.Create:
+		s = "create"
+	case n.SystemdUnit != "":
+		s = fmt.Sprintf("systemd-unit=%s", n.SystemdUnit)
+	case n.Machine != "":
+		s = fmt.Sprintf("machine=%s", n.Machine)
+	case n.SystemdScope != "":
+		s = fmt.Sprintf("systemd-scope=%s", n.SystemdScope)
+	case n.CGroup != "":
+		s = fmt.Sprintf("cgroup=%s", n.CGroup)
+	case n.PID > 0 && n.TID > 0:
+		s = fmt.Sprintf("pid=%d,tid=%d", n.PID, n.TID)
+	case n.PID > 0:
+		s = fmt.Sprintf("pid=%d", n.PID)
+	case n.NetName != "":
+		s = fmt.Sprintf("net-name=%s", n.NetName)
+	case n.DockerName != "":
+		s = fmt.Sprintf("docker-name=%s", n.DockerName)
+	case n.PodmanName != "":
+		s = fmt.Sprintf("podman-name=%s", n.PodmanName)
+	case n.ContainerdID != "":
+		s = fmt.Sprintf("containerd-id=%s/%s", n.ContainerdNamespace, n.ContainerdID)
+	case n.CRIPod != "" || len(n.CRILabel) > 0:
+		s = strings.Join(append([]string{"cri-pod=" + n.CRIPod}, n.CRILabel...), ",")
+	case n.Path != "":
+		s = fmt.Sprintf("path=%s", n.Path)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.armed && n.nsHandle.IsOpen() {
+		s = strings.TrimPrefix(fmt.Sprintf("%s %s", s, n.nsHandle.UniqueId()), " ")
+	}
+	return s
+}
+
 func (n *NetworkNamespace) Dialer(sourceIP string, timeout time.Duration) (*net.Dialer, error) {
 	if sourceIP == "" {
 		sourceIP = "[::]"
@@ -53,26 +122,119 @@ func (n *NetworkNamespace) Dialer(sourceIP string, timeout time.Duration) (*net.
 	return &net.Dialer{
 		LocalAddr: ip,
 		Timeout:   timeout,
-		Control: func(network, address string, c syscall.RawConn) error {
-			runtime.LockOSThread()
-			defer runtime.UnlockOSThread()
-			if err, _ := n.Enter(); err != nil {
+	}, nil
+}
+
+// Resolver looks up names from the namespace. The Go resolver queries
+// from goroutines of its own, its Dial creates their sockets in Do.
+func (n *NetworkNamespace) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+			if nerr := n.Do(func() error {
+				conn, err = (&net.Dialer{}).DialContext(ctx, network, address)
 				return err
+			}); err == nil {
+				err = nerr
 			}
-			return nil
+			return
 		},
-	}, nil
+	}
+}
+
+// resolve returns the literal addresses to dial for addr, looked up
+// from the namespace.
+func (n *NetworkNamespace) resolve(ctx context.Context, protocol, addr string) ([]string, error) {
+	if !strings.HasPrefix(protocol, "tcp") && !strings.HasPrefix(protocol, "udp") {
+		return []string{addr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	hosts, err := n.Resolver().LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{}
+	for _, h := range hosts {
+		addrs = append(addrs, net.JoinHostPort(h, port))
+	}
+	return addrs, nil
+}
+
+// Do runs f on a thread in the namespace, sockets created by f end up
+// in it. Dial with a Dialer inside of Do.
+func (n *NetworkNamespace) Do(f func() error) error {
+	if n.Disable {
+		return f()
+	}
+	if n.joins() {
+		return fmt.Errorf("%s: joining the user or mount namespace needs fork", n)
+	}
+
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("netns: Get: %v", err)
+	}
+	defer origin.Close()
+
+	n.mu.Lock()
+	if !n.lookedup {
+		if err, _ = n.refreshNetNSID(); err != nil {
+			err = fmt.Errorf("refreshNetNSID: %s", err)
+		}
+	}
+	if err == nil && !n.nsHandle.Equal(origin) {
+		if err = netns.Set(n.nsHandle); err != nil {
+			err = fmt.Errorf("netns: Set: %s", err)
+		}
+	}
+	n.mu.Unlock()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+
+	err = f()
+	if serr := netns.Set(origin); serr != nil {
+		// The thread stays locked and is thrown away with the goroutine.
+		return fmt.Errorf("failed to switch back to ns: %v", serr)
+	}
+	runtime.UnlockOSThread()
+	return err
 }
 
 func (n *NetworkNamespace) Close() {
-	if n.previousNsHandle.IsOpen() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// A handle that was never set is 0, that's stdin and not ours.
+	if n.previousNsHandle > 0 && n.previousNsHandle.IsOpen() {
 		n.previousNsHandle.Close()
 	}
-	if n.nsHandle.IsOpen() {
+	if n.nsHandle > 0 && n.nsHandle.IsOpen() {
 		n.nsHandle.Close()
 	}
 }
 
+// Remove deletes a namespace we created, with its veth pair.
+func (n *NetworkNamespace) Remove() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.created == nil {
+		return
+	}
+	if err := n.created.remove(); err != nil {
+		fmt.Printf("Error: remove %s: %v\n", n.NetName, err)
+	}
+	n.created = nil
+}
+
 func (n *NetworkNamespace) isOpen() error {
 	if !n.nsHandle.IsOpen() {
 		return fmt.Errorf("net fd closed for some reason")
@@ -86,6 +248,10 @@ func (n *NetworkNamespace) Enter() (err error, ok bool) {
 		return nil, false
 	}
 
+	// Follow may swap the handle while we use it.
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
 	if err = n.isOpen(); err != nil {
 		err = fmt.Errorf("isOpen: %s", err)
 		return
@@ -145,37 +311,96 @@ func (n *NetworkNamespace) refreshNetNSID() (error, bool) {
 
 	var errors []string
 
-	if n.PID < 1 && n.SystemdUnit != "" {
-		pid, err := n.getSystemdUnitMainPID(n.SystemdUnit)
+	h, err := n.lookup()
+	if err == nil && h.IsOpen() {
+		n.nsHandle = h
+		n.armed = true
+		return nil, true
+	}
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	if !n.armed {
+		h, err := netns.Get()
 		if err == nil {
-			var h netns.NsHandle
-			h, err = netns.GetFromPid(int(pid))
-			if err == nil {
-				n.nsHandle = h
-				n.armed = true
-				return nil, true
+			n.nsHandle, n.previousNsHandle = n.previousNsHandle, h
+			n.armed = true
+			return nil, true
+		}
+		errors = append(errors, fmt.Sprintf("path: %s", err))
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, ", ")), false
+	}
+
+	return nil, false
+}
+
+// lookup finds the namespace given by the options, it doesn't fall
+// back to the current namespace. The handle is not open if no
+// namespace was given.
+func (n *NetworkNamespace) lookup() (netns.NsHandle, error) {
+	var errors []string
+
+	if n.Create {
+		if n.created == nil {
+			e, err := createNetNs(n.NetName, n.Veth)
+			if err != nil {
+				return netns.None(), fmt.Errorf("create: %s", err)
 			}
+			n.created = e
+		}
+		// The handle we return is closed when it's replaced.
+		fd, err := unix.Dup(int(n.created.handle))
+		if err != nil {
+			return netns.None(), fmt.Errorf("create: %s", err)
+		}
+		return netns.NsHandle(fd), nil
+	}
+
+	if n.PID < 1 && n.SystemdUnit != "" {
+		h, pid, err := fromSource(n.unitPid)
+		if err == nil {
+			n.MainPID = pid
+			return h, nil
 		}
 		errors = append(errors, fmt.Sprintf("systemd.unit: %s", err))
 	}
 
+	if n.PID < 1 && n.Machine != "" {
+		h, pid, err := fromSource(n.machinePid)
+		if err == nil {
+			n.MainPID = pid
+			return h, nil
+		}
+		errors = append(errors, fmt.Sprintf("machine: %s", err))
+	}
+
+	if n.PID < 1 && (n.SystemdScope != "" || n.CGroup != "") {
+		keep := n.MainPID
+		h, pid, err := fromSource(func() (int, error) { return n.getCGroupPid(keep) })
+		if err == nil {
+			n.MainPID = pid
+			return h, nil
+		}
+		errors = append(errors, fmt.Sprintf("cgroup: %s", err))
+	}
+
 	// Handle both Systemd and PID directly
 	if n.PID > 0 {
-		h, err := netns.GetFromPid(n.PID)
+		h, err := getFromPid(n.PID, nil)
 		if err == nil {
-			n.nsHandle = h
-			n.armed = true
-			return nil, true
+			return h, nil
 		}
 		errors = append(errors, fmt.Sprintf("pid: %s", err))
 	}
 
 	if n.PID > 0 && n.TID > 0 {
-		h, err := netns.GetFromThread(n.PID, n.TID)
+		h, err := getFromThread(n.PID, n.TID)
 		if err == nil {
-			n.nsHandle = h
-			n.armed = true
-			return nil, true
+			return h, nil
 		}
 		errors = append(errors, fmt.Sprintf("tid: %s", err))
 	}
@@ -183,9 +408,7 @@ func (n *NetworkNamespace) refreshNetNSID() (error, bool) {
 	if n.NetName != "" {
 		h, err := netns.GetFromName(n.NetName)
 		if err == nil {
-			n.nsHandle = h
-			n.armed = true
-			return nil, true
+			return h, nil
 		}
 		errors = append(errors, fmt.Sprintf("net-name: %s", err))
 	}
@@ -193,38 +416,115 @@ func (n *NetworkNamespace) refreshNetNSID() (error, bool) {
 	if n.DockerName != "" {
 		h, err := netns.GetFromDocker(n.DockerName)
 		if err == nil {
-			n.nsHandle = h
-			n.armed = true
-			return nil, true
+			return h, nil
 		}
 		errors = append(errors, fmt.Sprintf("docker-name: %s", err))
 	}
 
+	if n.PodmanName != "" {
+		h, pid, err := fromSource(func() (int, error) { return getPodmanPid(n.Ctx, n.PodmanSocket, n.PodmanName) })
+		if err == nil {
+			n.MainPID = pid
+			return h, nil
+		}
+		errors = append(errors, fmt.Sprintf("podman-name: %s", err))
+	}
+
+	if n.ContainerdID != "" {
+		h, pid, err := fromSource(func() (int, error) {
+			return getContainerdPid(n.Ctx, n.ContainerdSocket, n.ContainerdNamespace, n.ContainerdID)
+		})
+		if err == nil {
+			n.MainPID = pid
+			return h, nil
+		}
+		errors = append(errors, fmt.Sprintf("containerd-id: %s", err))
+	}
+
+	if n.CRIPod != "" || len(n.CRILabel) > 0 {
+		pid, path, err := getCRISandbox(n.Ctx, n.CRISocket, n.CRIPod, n.CRILabel)
+		if err == nil {
+			var h netns.NsHandle
+			if pid > 0 {
+				h, err = getFromPid(pid, func() (int, error) {
+					pid, _, err := getCRISandbox(n.Ctx, n.CRISocket, n.CRIPod, n.CRILabel)
+					return pid, err
+				})
+			} else {
+				h, err = netns.GetFromPath(path)
+			}
+			if err == nil {
+				n.MainPID = pid
+				return h, nil
+			}
+		}
+		errors = append(errors, fmt.Sprintf("cri-pod: %s", err))
+	}
+
 	if n.Path != "" {
 		h, err := netns.GetFromPath(n.Path)
 		if err == nil {
-			n.nsHandle = h
-			n.armed = true
-			return nil, true
+			return h, nil
 		}
 		errors = append(errors, fmt.Sprintf("path: %s", err))
 	}
 
-	if !n.armed {
-		h, err := netns.Get()
+	if len(errors) > 0 {
+		return netns.None(), fmt.Errorf("%s", strings.Join(errors, ", "))
+	}
+
+	return netns.None(), nil
+}
+
+// WaitFor blocks until the namespace given by the options exists, for
+// at most Wait. status is told what we are waiting for.
+func (n *NetworkNamespace) WaitFor(status func(string)) error {
+	if n.Disable || n.Wait <= 0 || !n.IsSet() {
+		return nil
+	}
+
+	deadline := time.Now().Add(n.Wait)
+	backoff := 100 * time.Millisecond
+	for {
+		n.mu.Lock()
+		h, err := n.lookup()
+		if err == nil && h.IsOpen() {
+			n.nsHandle, n.armed, n.lookedup = h, true, true
+			n.mu.Unlock()
+			return nil
+		}
+		n.mu.Unlock()
 		if err == nil {
-			n.nsHandle, n.previousNsHandle = n.previousNsHandle, h
-			n.armed = true
-			return nil, true
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: not found after %s: %v", n, n.Wait, err)
+		}
+		status(fmt.Sprintf("waiting for %s: %v", n, err))
+
+		select {
+		case <-n.Ctx.Done():
+			return n.Ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
 		}
-		errors = append(errors, fmt.Sprintf("path: %s", err))
 	}
+}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("%s", strings.Join(errors, ", ")), false
+func (n *NetworkNamespace) unitPid() (int, error) {
+	pid, err := n.getSystemdUnitMainPID(n.SystemdUnit)
+	if err == nil && pid == 0 {
+		err = fmt.Errorf("no main process")
 	}
+	return int(pid), err
+}
 
-	return nil, false
+func (n *NetworkNamespace) machinePid() (int, error) {
+	pid, err := getMachineLeader(n.Machine)
+	return int(pid), err
 }
 
 func (n *NetworkNamespace) getSystemdUnitMainPID(unit string) (uint32, error) {
@@ -248,3 +548,202 @@ func (n *NetworkNamespace) getSystemdUnitMainPID(unit string) (uint32, error) {
 
 	return pid, nil
 }
+
+// getMachineLeader asks machined for the leader of a machine, for
+// systemd-nspawn that's the init of the container.
+func getMachineLeader(name string) (uint32, error) {
+	conn, err := machinedConn()
+	if err != nil {
+		return 0, err
+	}
+	props, err := conn.DescribeMachine(name)
+	if err != nil {
+		return 0, err
+	}
+	pid, ok := props["Leader"].(uint32)
+	if !ok || pid == 0 {
+		return 0, fmt.Errorf("%s has no leader: %v", name, props["Leader"])
+	}
+	return pid, nil
+}
+
+// machined is shared, a machine1.Conn can't be closed.
+var machined struct {
+	sync.Mutex
+	conn *machine1.Conn
+}
+
+func machinedConn() (*machine1.Conn, error) {
+	machined.Lock()
+	defer machined.Unlock()
+	if machined.conn == nil || !machined.conn.Connected() {
+		conn, err := machine1.New()
+		if err != nil {
+			return nil, err
+		}
+		machined.conn = conn
+	}
+	return machined.conn, nil
+}
+
+// Follow watches SystemdUnit over D-Bus and switches to the namespace
+// of its new main process when it restarts. Connections already made
+// in the old namespace are left alone, onChange is called after the
+// switch so that listeners in the namespace can be bound again.
+func (n *NetworkNamespace) Follow(onChange func()) error {
+	if n.Disable || n.PID > 0 {
+		return nil
+	}
+	if n.Machine != "" {
+		go n.followPid(onChange, n.refreshMachine)
+		return nil
+	}
+	if n.SystemdScope != "" || n.CGroup != "" {
+		go n.followPid(onChange, n.refreshCGroup)
+		return nil
+	}
+	if n.SystemdUnit == "" {
+		return nil
+	}
+
+	conn, err := dbus.NewWithContext(n.Ctx)
+	if err != nil {
+		return err
+	}
+	if err := conn.Subscribe(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	updates := make(chan *dbus.PropertiesUpdate, 16)
+	errs := make(chan error, 16)
+	conn.SetPropertiesSubscriber(updates, errs)
+
+	go func() {
+		defer conn.Close()
+		for {
+			select {
+			case <-n.Ctx.Done():
+				return
+			case err := <-errs:
+				if n.Debug {
+					fmt.Printf("Error: %s: %v\n", n.SystemdUnit, err)
+				}
+			case u := <-updates:
+				if u.UnitName != n.SystemdUnit {
+					continue
+				}
+				changed, err := n.refreshUnit()
+				if err != nil {
+					fmt.Printf("Error: %s: %v\n", n.SystemdUnit, err)
+					continue
+				}
+				if changed && onChange != nil {
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// followPid checks that the process we picked from the cgroup or
+// machine is still running and calls refresh to find another one when
+// it isn't.
+func (n *NetworkNamespace) followPid(onChange func(), refresh func() (bool, error)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		pid := n.MainPID
+		n.mu.Unlock()
+		// Not looked up yet or still running
+		if pid == 0 || syscall.Kill(pid, 0) != syscall.ESRCH {
+			continue
+		}
+
+		changed, err := refresh()
+		if err != nil {
+			if n.Debug {
+				fmt.Printf("Error: %s: %v\n", n, err)
+			}
+			continue
+		}
+		if changed && onChange != nil {
+			onChange()
+		}
+	}
+}
+
+// refreshUnit switches to the namespace of the current main process of
+// SystemdUnit, it reports whether the namespace changed.
+func (n *NetworkNamespace) refreshUnit() (bool, error) {
+	pid, err := n.getSystemdUnitMainPID(n.SystemdUnit)
+	if err != nil || pid == 0 {
+		// Stopped, keep the old namespace until it starts again.
+		return false, err
+	}
+	return n.switchPid(int(pid), n.unitPid)
+}
+
+// refreshMachine switches to the namespace of the new leader once a
+// machine has been started again.
+func (n *NetworkNamespace) refreshMachine() (bool, error) {
+	pid, err := n.machinePid()
+	if err != nil {
+		return false, err
+	}
+	return n.switchPid(pid, n.machinePid)
+}
+
+// refreshCGroup picks a new process from the cgroup once the current
+// one has left it.
+func (n *NetworkNamespace) refreshCGroup() (bool, error) {
+	n.mu.Lock()
+	keep := n.MainPID
+	n.mu.Unlock()
+
+	source := func() (int, error) { return n.getCGroupPid(keep) }
+	pid, err := source()
+	if err != nil {
+		// Empty, keep the old namespace until there is a process again.
+		return false, err
+	}
+	return n.switchPid(pid, source)
+}
+
+// switchPid switches to the namespace of pid, it reports whether the
+// namespace changed. source is what pid was looked up with.
+func (n *NetworkNamespace) switchPid(pid int, source func() (int, error)) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if pid == n.MainPID {
+		return false, nil
+	}
+
+	h, err := getFromPid(pid, source)
+	if err != nil {
+		return false, err
+	}
+	n.MainPID = pid
+	if h.Equal(n.nsHandle) {
+		h.Close()
+		return false, nil
+	}
+
+	if n.armed && n.nsHandle.IsOpen() && !n.nsHandle.Equal(n.previousNsHandle) {
+		n.nsHandle.Close()
+	}
+	n.nsHandle, n.armed, n.lookedup = h, true, true
+	if n.Debug {
+		fmt.Printf("following pid %d into %s\n", pid, h.UniqueId())
+	}
+	return true, nil
+}
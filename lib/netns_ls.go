@@ -0,0 +1,406 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// NetNsInfo describes a network namespace found by gopipe netns ls.
+// Selectors are the --*.netns.* options that find it.
+type NetNsInfo struct {
+	Inode      uint64   `json:"inode"`
+	Current    bool     `json:"current,omitempty"`
+	Pids       []int    `json:"pids,omitempty"`
+	Names      []string `json:"names,omitempty"`
+	Units      []string `json:"units,omitempty"`
+	Containers []string `json:"containers,omitempty"`
+	Machines   []string `json:"machines,omitempty"`
+	Listening  []string `json:"listening,omitempty"`
+	Selectors  []string `json:"selectors"`
+
+	path string
+}
+
+type NetNsCtl struct {
+	JSON bool `long:"json" description:"Print JSON instead of a table"`
+
+	out io.Writer
+}
+
+type netnsLs struct {
+	ctl          *NetNsCtl
+	NetnsDir     string `long:"netns-dir" default:"/run/netns" description:"Where iproute2 keeps named namespaces"`
+	DockerSocket string `long:"docker-socket" default:"/var/run/docker.sock" description:"Docker API socket"`
+	PodmanSocket string `long:"podman-socket" default:"/run/podman/podman.sock" description:"Podman API socket"`
+}
+
+func NetNsFunc(args []string) {
+	ctl := &NetNsCtl{out: os.Stdout}
+	parser := flags.NewNamedParser("gopipe netns", flags.Default)
+	if _, err := parser.AddGroup("netns", "", ctl); err != nil {
+		panic(err)
+	}
+	if _, err := parser.AddCommand("ls", "List network namespaces and what runs in them", "", &netnsLs{ctl: ctl}); err != nil {
+		panic(err)
+	}
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		if flags.WroteHelp(err) {
+			return
+		}
+		os.Exit(1)
+	}
+}
+
+func (l *netnsLs) Execute(args []string) error {
+	infos, err := l.list(context.Background())
+	if err != nil {
+		return err
+	}
+	if l.ctl.JSON {
+		enc := json.NewEncoder(l.ctl.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	}
+
+	var rows [][]string
+	for _, n := range infos {
+		pids := make([]string, 0, 3)
+		for i, pid := range n.Pids {
+			if i == 3 {
+				pids = append(pids, fmt.Sprintf("+%d", len(n.Pids)-i))
+				break
+			}
+			pids = append(pids, strconv.Itoa(pid))
+		}
+		inode := strconv.FormatUint(n.Inode, 10)
+		if n.Current {
+			inode += "*"
+		}
+		rows = append(rows, []string{
+			inode, orDash(strings.Join(pids, ",")),
+			orDash(strings.Join(n.Selectors, " ")), orDash(strings.Join(n.Listening, " ")),
+		})
+	}
+	return (&Ctl{out: l.ctl.out}).table("INODE\tPIDS\tSELECTORS\tLISTENING", rows)
+}
+
+// list finds network namespaces through processes, iproute2 names,
+// container runtimes and machined. Sources that aren't there are
+// skipped.
+func (l *netnsLs) list(ctx context.Context) ([]*NetNsInfo, error) {
+	byInode := map[uint64]*NetNsInfo{}
+	get := func(inode uint64) *NetNsInfo {
+		if n, ok := byInode[inode]; ok {
+			return n
+		}
+		n := &NetNsInfo{Inode: inode}
+		byInode[inode] = n
+		return n
+	}
+	pidInode := func(pid int) (uint64, bool) {
+		inode, err := nsInode(fmt.Sprintf("/proc/%d/ns/net", pid))
+		return inode, err == nil
+	}
+
+	current, err := nsInode("/proc/self/ns/net")
+	if err != nil {
+		return nil, err
+	}
+	get(current).Current = true
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		inode, ok := pidInode(pid)
+		if !ok {
+			continue
+		}
+		n := get(inode)
+		n.Pids = append(n.Pids, pid)
+		if inode == current {
+			continue
+		}
+		if unit := pidUnit(pid); unit != "" && !contains(n.Units, unit) {
+			n.Units = append(n.Units, unit)
+		}
+	}
+
+	if entries, err := os.ReadDir(l.NetnsDir); err == nil {
+		for _, e := range entries {
+			path := filepath.Join(l.NetnsDir, e.Name())
+			inode, err := nsInode(path)
+			if err != nil {
+				continue
+			}
+			n := get(inode)
+			n.Names = append(n.Names, e.Name())
+			n.path = path
+		}
+	}
+
+	for name, pid := range dockerPids(ctx, l.DockerSocket) {
+		if inode, ok := pidInode(pid); ok {
+			n := get(inode)
+			n.Containers = append(n.Containers, "docker:"+name)
+		}
+	}
+	for name, pid := range podmanPids(ctx, l.PodmanSocket) {
+		if inode, ok := pidInode(pid); ok {
+			n := get(inode)
+			n.Containers = append(n.Containers, "podman:"+name)
+		}
+	}
+	for name, pid := range machinePids() {
+		if inode, ok := pidInode(pid); ok {
+			n := get(inode)
+			n.Machines = append(n.Machines, name)
+		}
+	}
+
+	infos := []*NetNsInfo{}
+	for _, n := range byInode {
+		sort.Ints(n.Pids)
+		sort.Strings(n.Units)
+		sort.Strings(n.Containers)
+		sort.Strings(n.Machines)
+		n.Listening = n.listening()
+		n.Selectors = n.selectors()
+		infos = append(infos, n)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Current != infos[j].Current {
+			return infos[i].Current
+		}
+		return infos[i].Inode < infos[j].Inode
+	})
+	return infos, nil
+}
+
+func (n *NetNsInfo) selectors() []string {
+	s := []string{}
+	for _, name := range n.Names {
+		s = append(s, "net-name="+name)
+	}
+	for _, unit := range n.Units {
+		switch filepath.Ext(unit) {
+		case ".service":
+			s = append(s, "systemd-unit="+unit)
+		case ".scope", ".slice":
+			s = append(s, "systemd-scope="+unit)
+		}
+	}
+	for _, c := range n.Containers {
+		runtime, name, _ := strings.Cut(c, ":")
+		s = append(s, runtime+"-name="+name)
+	}
+	for _, m := range n.Machines {
+		s = append(s, "machine="+m)
+	}
+	if len(s) == 0 && len(n.Pids) > 0 && !n.Current {
+		s = append(s, fmt.Sprintf("pid=%d", n.Pids[0]))
+	}
+	return s
+}
+
+// listening returns the TCP sockets listening in the namespace. They
+// are read through a process in it, a namespace without processes is
+// entered.
+func (n *NetNsInfo) listening() []string {
+	var addrs []string
+	read := func(dir string) {
+		for _, f := range []string{"tcp", "tcp6"} {
+			data, err := os.ReadFile(filepath.Join(dir, f))
+			if err == nil {
+				addrs = append(addrs, parseProcNetListen(string(data))...)
+			}
+		}
+	}
+
+	switch {
+	case len(n.Pids) > 0:
+		read(fmt.Sprintf("/proc/%d/net", n.Pids[0]))
+	case n.path != "":
+		ns := &NetworkNamespace{Path: n.path}
+		ns.Do(func() error {
+			read("/proc/thread-self/net")
+			return nil
+		})
+		ns.Close()
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// parseProcNetListen returns the local addresses of listening sockets
+// in /proc/net/tcp or tcp6.
+func parseProcNetListen(data string) []string {
+	var addrs []string
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// TCP_LISTEN
+		if len(fields) < 4 || fields[3] != "0A" {
+			continue
+		}
+		host, port, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		b, err := hex.DecodeString(host)
+		if err != nil || (len(b) != 4 && len(b) != 16) {
+			continue
+		}
+		// The address is in 32 bit words in host byte order.
+		for i := 0; i < len(b); i += 4 {
+			b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+		}
+		p, err := strconv.ParseUint(port, 16, 16)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(net.IP(b).String(), strconv.FormatUint(p, 10)))
+	}
+	return addrs
+}
+
+func nsInode(path string) (uint64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("%s: no inode", path)
+	}
+	return st.Ino, nil
+}
+
+// pidUnit returns the systemd unit pid runs in, from its cgroup.
+func pidUnit(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// 0::/system.slice/app.service or 1:name=systemd:/...
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || (parts[0] != "0" && parts[1] != "name=systemd") {
+			continue
+		}
+		elems := strings.Split(parts[2], "/")
+		for i := len(elems) - 1; i >= 0; i-- {
+			if ext := filepath.Ext(elems[i]); ext == ".service" || ext == ".scope" {
+				return elems[i]
+			}
+		}
+	}
+	return ""
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func dockerPids(ctx context.Context, socket string) map[string]int {
+	pids := map[string]int{}
+	resp, err := getUnixHTTP(ctx, socket, "/containers/json")
+	if err != nil {
+		return pids
+	}
+	var list []struct {
+		Id    string
+		Names []string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return pids
+	}
+
+	for _, c := range list {
+		resp, err := getUnixHTTP(ctx, socket, "/containers/"+c.Id+"/json")
+		if err != nil {
+			continue
+		}
+		var inspect struct {
+			Name  string
+			State struct{ Pid int }
+		}
+		err = json.NewDecoder(resp.Body).Decode(&inspect)
+		resp.Body.Close()
+		if err == nil && inspect.State.Pid > 0 {
+			pids[strings.TrimPrefix(inspect.Name, "/")] = inspect.State.Pid
+		}
+	}
+	return pids
+}
+
+func podmanPids(ctx context.Context, socket string) map[string]int {
+	pids := map[string]int{}
+	resp, err := getUnixHTTP(ctx, socket, "/v4.0.0/libpod/containers/json")
+	if err != nil {
+		return pids
+	}
+	defer resp.Body.Close()
+	var list []struct {
+		Names []string
+		Pid   int
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return pids
+	}
+	for _, c := range list {
+		if len(c.Names) > 0 && c.Pid > 0 {
+			pids[c.Names[0]] = c.Pid
+		}
+	}
+	return pids
+}
+
+func machinePids() map[string]int {
+	pids := map[string]int{}
+	conn, err := machinedConn()
+	if err != nil {
+		return pids
+	}
+
+	machines, err := conn.ListMachines()
+	if err != nil {
+		return pids
+	}
+	for _, m := range machines {
+		// The host is listed as .host
+		if m.Class == "host" {
+			continue
+		}
+		if pid, err := getMachineLeader(m.Name); err == nil {
+			pids[m.Name] = int(pid)
+		}
+	}
+	return pids
+}
@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseProcNetListen(t *testing.T) {
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 2 1 0000000000000000 20 4 30 10 -1
+`
+	tcp6 := `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:0050 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 3 1 0000000000000000 100 0 0 10 0
+`
+	if addrs := parseProcNetListen(tcp); len(addrs) != 1 || addrs[0] != "127.0.0.1:8080" {
+		t.Fatalf("tcp: %v", addrs)
+	}
+	if addrs := parseProcNetListen(tcp6); len(addrs) != 1 || addrs[0] != "[::1]:80" {
+		t.Fatalf("tcp6: %v", addrs)
+	}
+}
+
+func TestNetNsLs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer ln.Close()
+
+	dir := t.TempDir()
+	l := &netnsLs{
+		NetnsDir:     dir,
+		DockerSocket: filepath.Join(dir, "docker.sock"),
+		PodmanSocket: filepath.Join(dir, "podman.sock"),
+	}
+	infos, err := l.list(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(infos) == 0 || !infos[0].Current {
+		t.Fatalf("current namespace isn't listed first: %+v", infos)
+	}
+	current := infos[0]
+	found := false
+	for _, pid := range current.Pids {
+		found = found || pid == os.Getpid()
+	}
+	if !found {
+		t.Fatalf("%d not in %v", os.Getpid(), current.Pids)
+	}
+	if !contains(current.Listening, ln.Addr().String()) {
+		t.Fatalf("%s not in %v", ln.Addr(), current.Listening)
+	}
+}
@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	godbus "github.com/godbus/dbus/v5"
+)
+
+func TestNetNsWaitFor(t *testing.T) {
+	statuses := 0
+	status := func(string) { statuses++ }
+
+	n := &NetworkNamespace{Path: "/nonexistent/netns", Wait: 300 * time.Millisecond, Ctx: context.Background()}
+	if err := n.WaitFor(status); err == nil {
+		t.Fatalf("found %s", n.Path)
+	}
+	if statuses == 0 {
+		t.Fatalf("no status while waiting")
+	}
+
+	n = &NetworkNamespace{Path: "/proc/self/ns/net", Wait: time.Second, Ctx: context.Background()}
+	if err := n.WaitFor(status); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer n.Close()
+	if !n.armed || !n.nsHandle.IsOpen() {
+		t.Fatalf("namespace not armed after wait")
+	}
+}
+
+type fakeMachined struct{}
+
+func (fakeMachined) GetMachine(name string) (godbus.ObjectPath, *godbus.Error) {
+	if name != "web" {
+		return "", godbus.NewError("org.freedesktop.machine1.NoSuchMachine", []interface{}{"No machine " + name})
+	}
+	return "/org/freedesktop/machine1/machine/web", nil
+}
+
+func (fakeMachined) ListMachines() ([][]interface{}, *godbus.Error) {
+	return [][]interface{}{
+		{".host", "host", "", godbus.ObjectPath("/org/freedesktop/machine1/machine/_2ehost")},
+		{"web", "container", "systemd-nspawn", godbus.ObjectPath("/org/freedesktop/machine1/machine/web")},
+	}, nil
+}
+
+type fakeMachine struct{}
+
+// GetAll answers for all interfaces, machined does that for "".
+func (fakeMachine) GetAll(iface string) (map[string]godbus.Variant, *godbus.Error) {
+	return map[string]godbus.Variant{"Leader": godbus.MakeVariant(uint32(os.Getpid()))}, nil
+}
+
+// startBus starts a private bus and makes it the system bus for the test.
+func startBus(t *testing.T) string {
+	bin, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(conf, []byte(`<busconfig>
+  <type>session</type>
+  <listen>unix:path=`+filepath.Join(dir, "bus")+`</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*"/>
+    <allow receive_sender="*"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>`), 0o600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cmd := exec.Command(bin, "--config-file="+conf, "--nofork", "--print-address")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	addr = strings.TrimSpace(addr)
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", addr)
+	return addr
+}
+
+func TestMachineLeader(t *testing.T) {
+	// Don't reuse a connection to another bus.
+	machined.conn = nil
+	conn, err := godbus.Dial(startBus(t))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	if err := conn.Auth(nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := conn.Hello(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err := conn.Export(fakeMachined{}, "/org/freedesktop/machine1", "org.freedesktop.machine1.Manager"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := conn.Export(fakeMachine{}, "/org/freedesktop/machine1/machine/web", "org.freedesktop.DBus.Properties"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := conn.RequestName("org.freedesktop.machine1", godbus.NameFlagDoNotQueue); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	pid, err := getMachineLeader("web")
+	if err != nil || int(pid) != os.Getpid() {
+		t.Fatalf("leader(%d) != %d: %v", pid, os.Getpid(), err)
+	}
+	if _, err := getMachineLeader("db"); err == nil {
+		t.Fatalf("found a leader for a missing machine")
+	}
+	if pids := machinePids(); len(pids) != 1 || pids["web"] != os.Getpid() {
+		t.Fatalf("machines %v", pids)
+	}
+
+	n := &NetworkNamespace{Machine: "web", Ctx: context.Background()}
+	defer n.Close()
+	if err, _ := n.refreshNetNSID(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n.MainPID != os.Getpid() {
+		t.Fatalf("MainPID(%d) != %d", n.MainPID, os.Getpid())
+	}
+}
+
+func TestNetNsCreate(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+
+	n := &NetworkNamespace{Create: true, Veth: "10.213.0.1/30,10.213.0.2/30", Ctx: context.Background()}
+	n.SetCurrent()
+	defer n.Close()
+
+	var ln net.Listener
+	if err := n.Do(func() (err error) {
+		ln, err = net.Listen("tcp", "10.213.0.2:0")
+		return
+	}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	buf, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q: %v", buf, err)
+	}
+
+	link := n.created.link
+	n.Remove()
+	if _, err := net.InterfaceByName(link); err == nil {
+		t.Fatalf("%s still exists", link)
+	}
+}
+
+func TestNetNsCloseUnset(t *testing.T) {
+	if _, err := os.Stdin.Stat(); err != nil {
+		t.Skipf("no stdin: %v", err)
+	}
+	(&NetworkNamespace{Disable: true}).Close()
+	if _, err := os.Stdin.Stat(); err != nil {
+		t.Fatalf("stdin closed: %v", err)
+	}
+}
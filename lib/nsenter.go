@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// nsenterEnv lists the namespace fds a child started through nsenter
+// has to close.
+const nsenterEnv = "GOPIPE_NSENTER_FDS"
+
+func (n *NetworkNamespace) joins() bool {
+	return !n.Disable && (n.UserNS || n.MountNS)
+}
+
+// checkJoin tells what nsenter can't do for a child started with attr.
+// nsenter is cloned with the flags and credentials of the child, and
+// has to join the namespaces with the ones gopipe has.
+func (n *NetworkNamespace) checkJoin(attr *syscall.SysProcAttr) error {
+	if n == nil || !n.joins() || attr == nil {
+		return nil
+	}
+	if attr.Credential != nil {
+		return fmt.Errorf("%s: --*.user, --*.uid and id maps can't be used when joining the user or mount namespace", n)
+	}
+	flags := attr.Cloneflags
+	if n.UserNS {
+		flags &^= syscall.CLONE_NEWUSER
+	} else if flags&syscall.CLONE_NEWUSER != 0 {
+		return fmt.Errorf("%s: a private user namespace can't join the mount namespace, use --*.netns.userns or --*.sandbox.disable=users", n)
+	}
+	private := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWCGROUP | syscall.CLONE_NEWTIME)
+	if flags&private != 0 && os.Geteuid() != 0 {
+		return fmt.Errorf("%s: the sandbox needs root to make namespaces when joining the user or mount namespace, use --*.sandbox=none", n)
+	}
+	return nil
+}
+
+// Start starts cmd in the namespace. A multithreaded process can't
+// join a user or mount namespace, so when those are joined too cmd is
+// started through nsenter, which joins them in order before it execs.
+func (n *NetworkNamespace) Start(cmd *exec.Cmd, drainTimeout time.Duration) (*Child, error) {
+	if !n.joins() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if err, _ := n.Enter(); err != nil {
+			return nil, err
+		}
+		// Switch back, the thread is reused and the handle too on restart.
+		defer n.Exit()
+		return StartChild(cmd, drainTimeout)
+	}
+
+	files, err := n.nsenter(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	return StartChild(cmd, drainTimeout)
+}
+
+// nsenter rewrites cmd to be started by nsenter. The namespaces are
+// opened here, through the pidfd of the process, and passed as extra
+// files. The returned files are closed once cmd has started.
+func (n *NetworkNamespace) nsenter(cmd *exec.Cmd) ([]*os.File, error) {
+	bin, err := exec.LookPath("nsenter")
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.lookedup {
+		if err, _ := n.refreshNetNSID(); err != nil {
+			return nil, fmt.Errorf("refreshNetNSID: %s", err)
+		}
+	}
+	pid := n.PID
+	if pid < 1 {
+		pid = n.MainPID
+	}
+	if pid < 1 || !n.nsHandle.IsOpen() {
+		// n.mu is held, String would lock it again.
+		return nil, fmt.Errorf("the user and mount namespace can only be joined for a namespace found through a process")
+	}
+
+	files := []*os.File{}
+	args := []string{}
+	add := func(name, opt string, h netns.NsHandle) {
+		fd := 3 + len(cmd.ExtraFiles) + len(files)
+		files = append(files, os.NewFile(uintptr(h), name))
+		args = append(args, fmt.Sprintf("--%s=/proc/self/fd/%d", opt, fd))
+	}
+	open := func(ns string) (netns.NsHandle, error) {
+		return getFromPidfd(pid, nil, func() (netns.NsHandle, error) {
+			return netns.GetFromPath(fmt.Sprintf("/proc/%d/ns/%s", pid, ns))
+		})
+	}
+
+	if n.UserNS {
+		h, err := open("user")
+		if err != nil {
+			return nil, fmt.Errorf("userns: %v", err)
+		}
+		add("userns", "user", h)
+	}
+	if n.MountNS {
+		h, err := open("mnt")
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("mountns: %v", err)
+		}
+		add("mountns", "mount", h)
+	}
+	fd, err := unix.Dup(int(n.nsHandle))
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, err
+	}
+	add("netns", "net", netns.NsHandle(fd))
+
+	fds := []string{}
+	for i := range files {
+		fds = append(fds, strconv.Itoa(3+len(cmd.ExtraFiles)+i))
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, nsenterEnv+"="+strings.Join(fds, ","))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, files...)
+
+	// Run as root of the user namespace, which is nsenter's default.
+	cmd.Args = append(append(append([]string{bin}, args...), "--", cmd.Path), cmd.Args[1:]...)
+	cmd.Path = bin
+
+	// Joining a user namespace from a new one isn't allowed, Prepare
+	// made sure it is the only thing left to strip.
+	if attr := cmd.SysProcAttr; attr != nil && n.UserNS {
+		attr.Cloneflags &^= syscall.CLONE_NEWUSER
+		attr.UidMappings, attr.GidMappings = nil, nil
+	}
+	return files, nil
+}
+
+// closeNsenterFds closes the namespace fds nsenter left open for us.
+func closeNsenterFds() {
+	v := os.Getenv(nsenterEnv)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(nsenterEnv)
+	for _, s := range strings.Split(v, ",") {
+		if fd, err := strconv.Atoi(s); err == nil {
+			unix.Close(fd)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNsenter(t *testing.T) {
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		t.Skip("nsenter not found")
+	}
+
+	n := &NetworkNamespace{PID: os.Getpid(), UserNS: true, MountNS: true, Ctx: context.Background()}
+	defer n.Close()
+	cmd := exec.Command("/bin/true", "a")
+	cmd.ExtraFiles = []*os.File{os.Stdin}
+	files, err := n.nsenter(cmd)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	args := strings.Join(cmd.Args[1:], " ")
+	if args != "--user=/proc/self/fd/4 --mount=/proc/self/fd/5 --net=/proc/self/fd/6 -- /bin/true a" {
+		t.Fatalf("args: %s", args)
+	}
+	if env := cmd.Env[len(cmd.Env)-1]; env != nsenterEnv+"=4,5,6" {
+		t.Fatalf("env: %s", env)
+	}
+
+	if os.Geteuid() != 0 {
+		return
+	}
+	// We can't join our own user namespace, but the mount namespace is fine.
+	want, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	n = &NetworkNamespace{PID: os.Getpid(), MountNS: true, Ctx: context.Background()}
+	defer n.Close()
+	out := &strings.Builder{}
+	cmd = exec.CommandContext(context.Background(), "readlink", "/proc/self/ns/net")
+	cmd.Stdout = out
+	child, err := n.Start(cmd, time.Second)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := child.Wait(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if strings.TrimSpace(out.String()) != want {
+		t.Fatalf("%s != %s", out, want)
+	}
+}
+
+// asNobody runs the tests matching run again as nobody. The test binary
+// is copied to where nobody can run it.
+func asNobody(t *testing.T, run string) {
+	dir, err := os.MkdirTemp("", "gopipe")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	src, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer src.Close()
+	bin := filepath.Join(dir, "test")
+	dst, err := os.OpenFile(bin, os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = io.Copy(dst, src)
+	dst.Close()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cmd := exec.Command(bin, "-test.run", run, "-test.v")
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if !strings.Contains(string(out), "--- PASS") {
+		t.Fatalf("didn't run: %s", out)
+	}
+}
+
+func TestProcPrepareJoin(t *testing.T) {
+	if os.Geteuid() == 0 {
+		asNobody(t, "^TestProcPrepareJoin$")
+		return
+	}
+
+	userns := &NetworkNamespace{PID: 1, UserNS: true}
+	mountns := &NetworkNamespace{PID: 1, MountNS: true}
+	for _, c := range []struct {
+		proc  *Proc
+		user  *User
+		netns *NetworkNamespace
+		ok    bool
+	}{
+		{&Proc{Sandbox: "none"}, &User{}, userns, true},
+		{&Proc{Sandbox: "none", SandboxEnable: []string{"users"}}, &User{}, userns, true},
+		{&Proc{}, &User{}, userns, false},
+		{&Proc{Sandbox: "none", SandboxEnable: []string{"mounts"}}, &User{}, userns, false},
+		{&Proc{Sandbox: "none"}, &User{UID: 1000, GID: 1000}, userns, false},
+		{&Proc{Sandbox: "none", SandboxEnable: []string{"users"}, UsernsUidMap: []string{"0:1000:1"}, UsernsGidMap: []string{"0:1000:1"}}, &User{}, userns, false},
+		{&Proc{Sandbox: "none"}, &User{}, mountns, true},
+		{&Proc{Sandbox: "none", SandboxEnable: []string{"users"}}, &User{}, mountns, false},
+		{&Proc{}, &User{}, &NetworkNamespace{PID: 1}, true},
+	} {
+		_, err := c.proc.Prepare(exec.Command("true"), c.user, c.netns)
+		if (err == nil) != c.ok {
+			t.Errorf("%+v %+v %+v: %v", c.proc, c.user, c.netns, err)
+		}
+	}
+}
+
+func TestNsenterNoProcess(t *testing.T) {
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		t.Skip("nsenter not found")
+	}
+
+	n := &NetworkNamespace{Path: "/proc/self/ns/net", MountNS: true, Ctx: context.Background()}
+	done := make(chan error, 1)
+	go func() {
+		_, err := n.nsenter(exec.Command("/bin/true"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		n.Close()
+		if err == nil {
+			t.Fatalf("joined without a process")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nsenter hangs")
+	}
+}
@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// getFromPid opens the network namespace of pid without racing pid
+// reuse. The process is pinned with a pidfd, source is asked again
+// whether pid still is the process it meant and the pidfd has to
+// still be running once the namespace is open. If it isn't,
+// /proc/<pid>/ns/net could have belonged to a new process with the
+// same pid and an error is returned.
+func getFromPid(pid int, source func() (int, error)) (netns.NsHandle, error) {
+	return getFromPidfd(pid, source, func() (netns.NsHandle, error) {
+		return netns.GetFromPid(pid)
+	})
+}
+
+// getFromThread is getFromPid for a thread of pid.
+func getFromThread(pid, tid int) (netns.NsHandle, error) {
+	return getFromPidfd(pid, nil, func() (netns.NsHandle, error) {
+		return netns.GetFromThread(pid, tid)
+	})
+}
+
+func getFromPidfd(pid int, source func() (int, error), open func() (netns.NsHandle, error)) (netns.NsHandle, error) {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if errors.Is(err, unix.ENOSYS) {
+		// Before Linux 5.3
+		return open()
+	}
+	if err != nil {
+		return netns.None(), fmt.Errorf("pidfd_open %d: %v", pid, err)
+	}
+	defer unix.Close(fd)
+
+	if source != nil {
+		current, err := source()
+		if err != nil {
+			return netns.None(), err
+		}
+		if current != pid {
+			return netns.None(), fmt.Errorf("process %d was replaced by %d", pid, current)
+		}
+	}
+
+	h, err := open()
+	if err != nil {
+		return netns.None(), err
+	}
+	if err := unix.PidfdSendSignal(fd, 0, nil, 0); err != nil {
+		h.Close()
+		return netns.None(), fmt.Errorf("process %d exited while its namespace was opened: %v", pid, err)
+	}
+	return h, nil
+}
+
+// fromSource looks up a pid with source and opens its namespace.
+func fromSource(source func() (int, error)) (netns.NsHandle, int, error) {
+	pid, err := source()
+	if err != nil {
+		return netns.None(), 0, err
+	}
+	h, err := getFromPid(pid, source)
+	return h, pid, err
+}
@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestGetFromPid(t *testing.T) {
+	h, err := getFromPid(os.Getpid(), func() (int, error) { return os.Getpid(), nil })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	h.Close()
+
+	if _, err := getFromPid(os.Getpid(), func() (int, error) { return 1, nil }); err == nil {
+		t.Fatalf("opened the namespace of a replaced process")
+	}
+
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer cmd.Wait()
+	// The process exits after it has been pinned, like a unit that
+	// restarts while we look it up.
+	source := func() (int, error) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return cmd.Process.Pid, nil
+	}
+	if h, err := getFromPid(cmd.Process.Pid, source); err == nil {
+		h.Close()
+		t.Fatalf("opened the namespace of an exited process")
+	}
+}
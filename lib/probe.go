@@ -0,0 +1,221 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// Probe dials like a proxy with the same client options would and
+// reports each step.
+type Probe struct {
+	Client Client `group:"client" namespace:"client"`
+	// Only the allowed DNS names are used, the peer certificate is
+	// checked against them like the listen side of a pipe does.
+	Listen ListenTLS `group:"listen" namespace:"listen.tls"`
+	JSON   bool      `long:"json" description:"Print JSON"`
+
+	out io.Writer
+}
+
+type ProbeCert struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	DNSNames []string  `json:"dns_names,omitempty"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+type ProbeResult struct {
+	NetNs     string        `json:"netns,omitempty"`
+	Addr      string        `json:"addr"`
+	Resolved  []string      `json:"resolved,omitempty"`
+	Resolve   time.Duration `json:"resolve_ns,omitempty"`
+	Remote    string        `json:"remote,omitempty"`
+	Source    string        `json:"source,omitempty"`
+	Connect   time.Duration `json:"connect_ns,omitempty"`
+	Version   string        `json:"tls_version,omitempty"`
+	Cipher    string        `json:"tls_cipher,omitempty"`
+	ALPN      string        `json:"alpn,omitempty"`
+	Handshake time.Duration `json:"handshake_ns,omitempty"`
+	Verified  bool          `json:"verified,omitempty"`
+	Chain     []ProbeCert   `json:"chain,omitempty"`
+	Allowed   *bool         `json:"allowed,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+func ProbeFunc(args []string) {
+	p := &Probe{out: os.Stdout}
+	parser := flags.NewNamedParser("gopipe probe", flags.Default)
+	if _, err := parser.AddGroup("probe", "", p); err != nil {
+		panic(err)
+	}
+	for _, name := range []string{"ca-file", "cert-file", "key-file", "debug"} {
+		parser.FindOptionByLongName("listen.tls." + name).Hidden = true
+	}
+	if _, err := parser.ParseArgs(args); err != nil {
+		if flags.WroteHelp(err) {
+			return
+		}
+		os.Exit(1)
+	}
+
+	r := p.Run(context.Background())
+	if err := p.print(r); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	if r.Error != "" {
+		os.Exit(1)
+	}
+}
+
+func (p *Probe) Run(ctx context.Context) *ProbeResult {
+	c := &p.Client
+	r := &ProbeResult{Addr: c.GetAddr()}
+	fail := func(step string, err error) *ProbeResult {
+		r.Error = fmt.Sprintf("%s: %v", step, err)
+		return r
+	}
+
+	if err := c.TLS.TLSConfig(); err != nil {
+		return fail("tls", err)
+	}
+
+	n := &c.NetNs
+	n.Ctx, n.Protocol = ctx, c.Protocol
+	if !n.Disable {
+		if err := n.SetCurrent(); err != nil {
+			return fail("netns", err)
+		}
+	}
+	defer n.Close()
+	if err := n.WaitFor(func(string) {}); err != nil {
+		return fail("netns", err)
+	}
+	r.NetNs = n.String()
+
+	host, port, err := net.SplitHostPort(c.GetAddr())
+	if err != nil {
+		return fail("addr", err)
+	}
+	addrs := []string{c.GetAddr()}
+	if net.ParseIP(host) == nil {
+		start := time.Now()
+		r.Resolved, err = n.Resolver().LookupHost(ctx, host)
+		r.Resolve = time.Since(start)
+		if err != nil {
+			return fail("resolve", err)
+		}
+		addrs = addrs[:0]
+		for _, ip := range r.Resolved {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+
+	// Dialed like the proxy does, the addresses that were resolved are
+	// dialed one at a time.
+	dialer := &Dialer{NetNs: n, SourceIP: c.SourceIP, Timeout: c.Timeout}
+	dctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	start := time.Now()
+	var conn net.Conn
+	for _, addr := range addrs {
+		if conn, err = dialer.Dial(dctx, c.Protocol, addr); err == nil || dctx.Err() != nil {
+			break
+		}
+	}
+	r.Connect = time.Since(start)
+	if err != nil {
+		return fail("connect", err)
+	}
+	defer conn.Close()
+	r.Remote, r.Source = conn.RemoteAddr().String(), conn.LocalAddr().String()
+
+	if c.TLS.config == nil {
+		return r
+	}
+
+	config := c.TLS.config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	tc := tls.Client(conn, config)
+	hctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	start = time.Now()
+	err = tc.HandshakeContext(hctx)
+	r.Handshake = time.Since(start)
+
+	state := tc.ConnectionState()
+	for _, cert := range state.PeerCertificates {
+		r.Chain = append(r.Chain, ProbeCert{
+			Subject:  cert.Subject.String(),
+			Issuer:   cert.Issuer.String(),
+			DNSNames: cert.DNSNames,
+			NotAfter: cert.NotAfter,
+		})
+	}
+	if err != nil {
+		return fail("tls", err)
+	}
+	r.Version = tls.VersionName(state.Version)
+	r.Cipher = tls.CipherSuiteName(state.CipherSuite)
+	r.ALPN = state.NegotiatedProtocol
+	r.Verified = len(state.VerifiedChains) > 0
+
+	if len(p.Listen.AllowedDNSNames) > 0 {
+		raw := [][]byte{}
+		for _, cert := range state.PeerCertificates {
+			raw = append(raw, cert.Raw)
+		}
+		err := p.Listen.verifyPeerCertificate(raw, state.VerifiedChains)
+		allowed := err == nil
+		r.Allowed = &allowed
+		if err != nil {
+			return fail("peer", err)
+		}
+	}
+	return r
+}
+
+func (p *Probe) print(r *ProbeResult) error {
+	if p.JSON {
+		enc := json.NewEncoder(p.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	var rows [][]string
+	add := func(step, format string, a ...interface{}) {
+		rows = append(rows, []string{step, fmt.Sprintf(format, a...)})
+	}
+	add("netns", "%s", orDash(r.NetNs))
+	if len(r.Resolved) > 0 {
+		add("resolve", "%s (%s)", strings.Join(r.Resolved, ", "), r.Resolve)
+	}
+	if r.Remote != "" {
+		add("connect", "%s from %s (%s)", r.Remote, r.Source, r.Connect)
+	}
+	if r.Version != "" {
+		alpn := orDash(r.ALPN)
+		add("tls", "%s %s alpn=%s verified=%t (%s)", r.Version, r.Cipher, alpn, r.Verified, r.Handshake)
+	}
+	for i, cert := range r.Chain {
+		add(fmt.Sprintf("cert %d", i), "%s issuer=%s dns=%s expires %s",
+			cert.Subject, cert.Issuer, orDash(strings.Join(cert.DNSNames, ",")), cert.NotAfter.Format(time.RFC3339))
+	}
+	if r.Allowed != nil {
+		add("peer", "allowed=%t", *r.Allowed)
+	}
+	if r.Error != "" {
+		add("error", "%s", r.Error)
+	}
+	return (&Ctl{out: p.out}).table("STEP\tRESULT", rows)
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	// The probe closes the connection after the handshake.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	probe := func(allowed ...string) *ProbeResult {
+		p := &Probe{
+			Client: Client{
+				Addr:     &Addr{Addr: srv.Listener.Addr().String()},
+				Protocol: "tcp",
+				Timeout:  5 * time.Second,
+				TLS:      ClientTLS{CAFiles: []string{ca}},
+				NetNs:    NetworkNamespace{Disable: true},
+			},
+			Listen: ListenTLS{AllowedDNSNames: allowed},
+			out:    &bytes.Buffer{},
+		}
+		r := p.Run(context.Background())
+		if err := p.print(r); err != nil {
+			t.Fatalf("%v", err)
+		}
+		return r
+	}
+
+	r := probe("example.com")
+	if r.Error != "" {
+		t.Fatalf("%s", r.Error)
+	}
+	if !r.Verified || r.Version == "" || len(r.Chain) == 0 || r.Allowed == nil || !*r.Allowed {
+		t.Fatalf("unexpected result: %+v", r)
+	}
+	if !strings.HasPrefix(r.Source, "127.0.0.1:") {
+		t.Fatalf("source(%s) isn't 127.0.0.1", r.Source)
+	}
+
+	if r := probe("other.example.com"); !strings.HasPrefix(r.Error, "peer:") {
+		t.Fatalf("peer not checked against allowed names: %+v", r)
+	}
+}
+
+// TestProbeNetNsName probes a name that only the DNS server of a new
+// namespace knows.
+func TestProbeNetNsName(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create namespaces")
+	}
+
+	n := &NetworkNamespace{Create: true, NetName: "gopipe-probe-test", Protocol: "tcp", Ctx: context.Background()}
+	n.SetCurrent()
+	defer n.Close()
+	defer n.Remove()
+	nsDNS(t, n, map[string][]net.IP{"backend.gopipe.test.": {net.ParseIP("127.0.0.1")}})
+
+	var ln net.Listener
+	if err := n.Do(func() (err error) {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		return
+	}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	p := &Probe{
+		Client: Client{
+			Addr:     &Addr{Addr: net.JoinHostPort("backend.gopipe.test", port)},
+			Protocol: "tcp",
+			Timeout:  5 * time.Second,
+			NetNs:    NetworkNamespace{NetName: n.NetName},
+		},
+		out: &bytes.Buffer{},
+	}
+	r := p.Run(context.Background())
+	if r.Error != "" {
+		t.Fatalf("%s", r.Error)
+	}
+	if len(r.Resolved) != 1 || r.Resolved[0] != "127.0.0.1" || r.Remote != ln.Addr().String() {
+		t.Fatalf("unexpected result: %+v", r)
+	}
+}
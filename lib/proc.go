@@ -3,29 +3,57 @@ package lib
 import (
 	"context"
 	"fmt"
-	"net"
 	"os"
 	"os/exec"
-	"runtime"
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type Proc struct {
-	Ctx    context.Context
-	Chroot string
+	Ctx context.Context
+
+	ShouldFork     bool     `long:"fork" description:"fork process"`
+	Sandbox        string   `long:"sandbox" default:"default" choice:"strict" choice:"default" choice:"none" description:"Namespaces the forked process gets"`
+	SandboxEnable  []string `long:"sandbox.enable" description:"Add to the sandbox profile: cgroup, clock, io, ipc, mounts, pid, users, uts or untraced"`
+	SandboxDisable []string `long:"sandbox.disable" description:"Remove from the sandbox profile"`
+	Seccomp        string   `long:"seccomp" choice:"log" choice:"kill" description:"Only allow the syscalls the forked process needs, log or kill on others"`
+	SeccompProfile string   `long:"seccomp.profile" description:"JSON file with the allowed syscalls, instead of the built-in ones"`
+	Landlock       bool     `long:"landlock" description:"Only let the forked process read its TLS files and CA bundles"`
+	DropCaps       bool     `long:"drop-caps" description:"Drop all capabilities of the forked process but --caps"`
+	Caps           []string `long:"caps" description:"Capabilities the forked process keeps, e.g. net_bind_service, implies drop-caps"`
+	AmbientCaps    []string `long:"ambient-caps" description:"Capabilities the forked process keeps when running as another user"`
+	NoNewPrivs     bool     `long:"no-new-privs" description:"Keep the forked process from gaining privileges through exec"`
+	PrivateRoot    bool     `long:"private-root" description:"Run the forked process in an empty root with only its TLS files, CA bundles and sockets"`
+	Chroot         string   `long:"chroot" description:"Run the forked process chrooted here, or if private-root fails"`
+	UsernsSubids   string   `long:"userns.subids" description:"Map root and up in the user namespace of the forked process to the range of this user in /etc/subuid and /etc/subgid"`
+	UsernsUidMap   []string `long:"userns.uid-map" description:"Map uids in the user namespace of the forked process, inside:outside:count"`
+	UsernsGidMap   []string `long:"userns.gid-map" description:"Map gids in the user namespace of the forked process, inside:outside:count"`
+	CGroup         bool     `long:"cgroup" description:"Put the forked process in a cgroup of its own, below the one of gopipe"`
+	CGroupMemory   string   `long:"cgroup.memory-max" description:"memory.max of the cgroup of the forked process, e.g. 256M, implies cgroup"`
+	CGroupPids     string   `long:"cgroup.pids-max" description:"pids.max of the cgroup of the forked process, implies cgroup"`
+	CGroupCPU      string   `long:"cgroup.cpu-max" description:"cpu.max of the cgroup of the forked process, e.g. 50% or \"50000 100000\", implies cgroup"`
 
-	ShouldFork bool `long:"fork" description:"fork process"`
+	Restart           string        `long:"restart" default:"never" choice:"never" choice:"on-failure" choice:"always" description:"Start the forked process again when it exits"`
+	RestartBackoff    time.Duration `long:"restart.backoff" default:"1s" description:"Wait before restarting, doubled on each restart up to restart.max-backoff"`
+	RestartMaxBackoff time.Duration `long:"restart.max-backoff" default:"30s" description:"Longest wait before restarting"`
+	RestartMax        int           `long:"restart.max" default:"5" description:"Give up after this many restarts within restart.window, 0 for no limit"`
+	RestartWindow     time.Duration `long:"restart.window" default:"1m" description:"Restarts within this long count towards restart.max, running this long resets the backoff"`
 
-	Cloneflags *Cloneflags
-	Uid        int
-	Gid        int
+	Cloneflags  *Cloneflags
+	Uid         int
+	Gid         int
+	Groups      []int
+	UidMappings []syscall.SysProcIDMap
+	GidMappings []syscall.SysProcIDMap
 }
 
 func (p *Proc) SetUserGroup(u *User) error {
 	if err := u.Lookup(); err != nil {
 		return err
 	}
-	p.Uid, p.Gid = u.UID, u.GID
+	p.Uid, p.Gid, p.Groups = u.UID, u.GID, u.groups
 	return nil
 }
 
@@ -35,9 +63,18 @@ type OSFile interface {
 
 func (p *Proc) SetSysProcAttr(c *exec.Cmd) {
 	c.SysProcAttr = p.Cloneflags.Set()
-	if p.Uid > 0 || p.Gid > 0 {
+	// In a mapped user namespace root is switched to as well, the ids
+	// are those inside it.
+	if p.Uid > 0 || p.Gid > 0 || len(p.Groups) > 0 || len(p.UidMappings) > 0 {
 		c.SysProcAttr.Credential = &syscall.Credential{}
 	}
+	if len(p.UidMappings) > 0 {
+		c.SysProcAttr.UidMappings, c.SysProcAttr.GidMappings = p.UidMappings, p.GidMappings
+		c.SysProcAttr.GidMappingsEnableSetgroups = true
+	}
+	for _, g := range p.Groups {
+		c.SysProcAttr.Credential.Groups = append(c.SysProcAttr.Credential.Groups, uint32(g))
+	}
 	if p.Uid > 0 {
 		c.SysProcAttr.Credential.Uid = uint32(p.Uid)
 	}
@@ -46,63 +83,262 @@ func (p *Proc) SetSysProcAttr(c *exec.Cmd) {
 	}
 }
 
-func ForkUnixConn(ctx context.Context, user *User, netns *NetworkNamespace, bin string, args ...string) (*exec.Cmd, *net.UnixConn, error) {
-	cmd := exec.CommandContext(ctx, bin, args...)
+// checkIDMaps tells if the user and groups of p are mapped in its user
+// namespace. Without mappings only root is, to the overflow uid.
+func (p *Proc) checkIDMaps() error {
+	if len(p.UidMappings) == 0 && len(p.GidMappings) == 0 {
+		if p.Cloneflags.PrivateUsers && (p.Uid > 0 || p.Gid > 0 || len(p.Groups) > 0) {
+			return fmt.Errorf("users can't be private when switching to %d:%d without --*.userns.subids or maps", p.Uid, p.Gid)
+		}
+		return nil
+	}
+	if !p.Cloneflags.PrivateUsers {
+		return fmt.Errorf("uid and gid maps need a private user namespace, the users sandbox flag")
+	}
+	if len(p.UidMappings) == 0 || len(p.GidMappings) == 0 {
+		return fmt.Errorf("both uids and gids have to be mapped")
+	}
+	if !idMapped(p.UidMappings, p.Uid) {
+		return fmt.Errorf("uid %d is not mapped in the user namespace", p.Uid)
+	}
+	for _, g := range append([]int{p.Gid}, p.Groups...) {
+		if !idMapped(p.GidMappings, g) {
+			return fmt.Errorf("gid %d is not mapped in the user namespace", g)
+		}
+	}
+	return nil
+}
 
+// Prepare sets up cmd to run as user in the sandbox of p. Flags that
+// won't work are reported here, before anything is forked. The
+// returned Proc is what the child is started with and what it sets up
+// itself. netns is the namespace it is started in, if any.
+func (p *Proc) Prepare(cmd *exec.Cmd, user *User, netns *NetworkNamespace) (*Proc, error) {
+	if p == nil {
+		p = &Proc{}
+	}
 	cloneflags, err := NewCloneflags()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if err := user.Lookup(); err != nil {
-		return nil, nil, err
+	child := &Proc{Cloneflags: cloneflags}
+	if err := child.SetUserGroup(user); err != nil {
+		return nil, err
+	}
+	if child.UidMappings, child.GidMappings, err = p.idMaps(); err != nil {
+		return nil, err
+	}
+	// Mapped ids are switched to inside a user namespace of its own.
+	root := child.Uid == 0 && child.Gid == 0 && len(child.Groups) == 0
+	if err := cloneflags.Profile(p.Sandbox, root || len(child.UidMappings) > 0); err != nil {
+		return nil, err
+	}
+	if err := cloneflags.Override(p.SandboxEnable, p.SandboxDisable); err != nil {
+		return nil, err
+	}
+	if err := child.checkIDMaps(); err != nil {
+		cloneflags.Errors = append(cloneflags.Errors, err)
 	}
 
-	cloneflags.PrivateMounts = true
-	cloneflags.PrivatePID = true
-	if user.UID == 0 && user.GID == 0 {
-		cloneflags.PrivateUsers = true
+	limits, err := p.cgroupLimits()
+	if err != nil {
+		return nil, err
 	}
-	cloneflags.PrivateUTS = true
-	// hangs child process
-	// cloneflags.PrivateTLS = true
-	cloneflags.PrivateIO = true
-	cloneflags.PrivateIPC = true
-	cloneflags.PrivateClock = true
-	cloneflags.PrivateCGroup = true
+	cloneflags.JoinCGroup = limits != nil
 
-	p := &Proc{Cloneflags: cloneflags}
-	if err := p.SetUserGroup(user); err != nil {
-		return nil, nil, err
+	child.SetSysProcAttr(cmd)
+	if err := cloneflags.Err(); err != nil {
+		return nil, err
+	}
+	if err := netns.checkJoin(cmd.SysProcAttr); err != nil {
+		return nil, err
 	}
-	p.SetSysProcAttr(cmd)
 
-	conns, err := UnixPipe()
+	ambient, err := parseCaps(p.AmbientCaps)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if len(ambient) > 0 && child.Uid == 0 {
+		return nil, fmt.Errorf("ambient capabilities need --*.user or --*.uid")
+	}
+	if _, err := parseCaps(p.Caps); err != nil {
+		return nil, err
 	}
 
-	fc, _ := conns[1].(*net.UnixConn).File()
-	cmd.ExtraFiles, cmd.Stdout, cmd.Stderr = []*os.File{fc}, os.Stdout, os.Stderr
+	if p.PrivateRoot && !cloneflags.PrivateMounts {
+		return nil, fmt.Errorf("private-root needs a private mount namespace, the mounts sandbox flag")
+	}
 
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-	err, _ = netns.Enter()
-	if err != nil {
-		return nil, nil, err
+	// The child drops what it doesn't need itself, a bounding set
+	// can't be set up for it. As another user it needs CAP_SETPCAP
+	// for that, and the capabilities to change its root, which it
+	// drops too.
+	chroot := p.PrivateRoot || p.Chroot != ""
+	drop := p.DropCaps || len(p.Caps) > 0 || (chroot && child.Uid > 0)
+	if drop && child.Uid > 0 {
+		ambient = append(ambient, unix.CAP_SETPCAP)
+	}
+	if chroot && child.Uid > 0 {
+		ambient = append(ambient, unix.CAP_SYS_ADMIN, unix.CAP_SYS_CHROOT)
+	}
+	if len(ambient) > 0 {
+		cmd.SysProcAttr.AmbientCaps = ambient
+	}
+	child.DropCaps = drop
+	if drop {
+		child.Caps = append(append([]string{}, p.Caps...), p.AmbientCaps...)
+	}
+	child.NoNewPrivs, child.PrivateRoot, child.Chroot, child.Landlock = p.NoNewPrivs, p.PrivateRoot, p.Chroot, p.Landlock
+	// The child loads the filter itself once it knows its role.
+	if p.Seccomp != "" && p.SeccompProfile != "" {
+		if _, err := seccompPolicy(p.Seccomp, "", p.SeccompProfile); err != nil {
+			return nil, fmt.Errorf("seccomp: %v", err)
+		}
+	}
+	child.Seccomp, child.SeccompProfile = p.Seccomp, p.SeccompProfile
+
+	// Last, StartChild removes it when the child has exited.
+	if limits != nil {
+		fd, err := newChildCGroup(limits)
+		if err != nil {
+			return nil, fmt.Errorf("cgroup: %v", err)
+		}
+		cmd.SysProcAttr.CgroupFD = fd
+	}
+	return child, nil
+}
+
+// childSandbox is what a child started with p sets up itself.
+func (p *Proc) childSandbox() ChildSandbox {
+	return ChildSandbox{
+		Seccomp:        p.Seccomp,
+		SeccompProfile: p.SeccompProfile,
+		Landlock:       p.Landlock,
+		DropCaps:       p.DropCaps,
+		Caps:           p.Caps,
+		NoNewPrivs:     p.NoNewPrivs,
+		PrivateRoot:    p.PrivateRoot,
+		Chroot:         p.Chroot,
 	}
-	defer netns.Close()
+}
+
+// cgroupLimits returns the limits of the cgroup of a forked child, nil
+// if it gets none.
+func (p *Proc) cgroupLimits() (map[string]string, error) {
+	if !p.CGroup && p.CGroupMemory == "" && p.CGroupPids == "" && p.CGroupCPU == "" {
+		return nil, nil
+	}
+	limits := map[string]string{}
+	if p.CGroupMemory != "" {
+		limits["memory.max"] = p.CGroupMemory
+	}
+	if p.CGroupPids != "" {
+		limits["pids.max"] = p.CGroupPids
+	}
+	if p.CGroupCPU != "" {
+		v, err := cpuMax(p.CGroupCPU)
+		if err != nil {
+			return nil, err
+		}
+		limits["cpu.max"] = v
+	}
+	return limits, nil
+}
+
+// Child is a started process that several goroutines can wait for.
+type Child struct {
+	*exec.Cmd
+
+	done chan struct{}
+	err  error
+}
+
+// StartChild starts cmd. If ctx of cmd is cancelled the child is
+// interrupted so that it can drain, and killed after drainTimeout.
+func StartChild(cmd *exec.Cmd, drainTimeout time.Duration) (*Child, error) {
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = drainTimeout
+
+	// The cgroup Prepare made for it goes with the child.
+	var cgroup string
+	if attr := cmd.SysProcAttr; attr != nil && attr.UseCgroupFD && attr.CgroupFD >= 0 {
+		cgroup, _ = os.Readlink(fmt.Sprintf("/proc/self/fd/%d", attr.CgroupFD))
+		defer func() {
+			unix.Close(attr.CgroupFD)
+			attr.CgroupFD = -1
+		}()
+	}
+
 	if err := cmd.Start(); err != nil {
+		if cgroup != "" {
+			removeCGroup(cgroup)
+		}
 		if err, ok := err.(*exec.ExitError); ok {
-			return nil, nil, fmt.Errorf("unable to start process: %v, %s, %s", err, err.Stderr, cmd.Environ())
+			return nil, fmt.Errorf("unable to start process: %v, %s, %s", err, err.Stderr, cmd.Environ())
 		}
-		return nil, nil, fmt.Errorf("unable to start process: %v", err)
+		return nil, fmt.Errorf("unable to start process: %v", err)
 	}
 
-	uc, ok := conns[0].(*net.UnixConn)
-	if !ok {
-		return nil, nil, fmt.Errorf("unable to convert conn to unixconn")
+	c := &Child{Cmd: cmd, done: make(chan struct{})}
+	go func() {
+		c.err = cmd.Wait()
+		if cgroup != "" {
+			removeCGroup(cgroup)
+		}
+		close(c.done)
+	}()
+
+	return c, nil
+}
+
+// releaseCGroup removes the cgroup Prepare made for cmd when it wasn't
+// started, StartChild takes it over otherwise.
+func releaseCGroup(cmd *exec.Cmd) {
+	attr := cmd.SysProcAttr
+	if attr == nil || !attr.UseCgroupFD || attr.CgroupFD < 0 {
+		return
+	}
+	if dir, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", attr.CgroupFD)); err == nil {
+		removeCGroup(dir)
 	}
+	unix.Close(attr.CgroupFD)
+	attr.CgroupFD = -1
+}
+
+func (c *Child) Wait() error {
+	<-c.done
+	return c.err
+}
 
-	return cmd, uc, nil
+func (c *Child) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Child) Pid() int {
+	if c == nil || c.Process == nil {
+		return 0
+	}
+	return c.Process.Pid
+}
+
+// Drain sends a drain message over via, unless via is nil, and waits
+// for the child to exit. It is killed if it's still running after timeout.
+func (c *Child) Drain(via OSFile, timeout time.Duration) error {
+	if via != nil {
+		if err := WriteMsgConn(via, DrainMsg(timeout)); err != nil {
+			c.Process.Kill()
+			return fmt.Errorf("unable to drain process %d: %v", c.Pid(), err)
+		}
+	}
+
+	select {
+	case <-c.done:
+		return nil
+	case <-time.After(timeout):
+		c.Process.Kill()
+		return fmt.Errorf("process %d killed after drain timeout %s", c.Pid(), timeout)
+	}
 }
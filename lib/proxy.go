@@ -36,89 +36,139 @@ func (c *CloseWriter) Close() error {
 			err = fmt.Errorf("(%s->%s): CloseWrite failed: %v", c.Conn.LocalAddr(), c.Conn.RemoteAddr(), err)
 			fmt.Printf("%v\n", err)
 		}
-
+	case *PeerConn:
+		return (&CloseWriter{conn.Conn}).Close()
 	}
 	return c.Conn.Close()
 }
 
 type UnixConnListener struct {
 	*net.UnixConn
+
+	// OnDrain is called when the sending side is draining.
+	OnDrain func(time.Duration)
+	// OnListener is given listeners passed back by the sending side.
+	OnListener func(*os.File)
+	// OnReload is called when the sending side asks to reload TLS
+	// certificates.
+	OnReload func()
 }
 
 func (u *UnixConnListener) Addr() net.Addr {
 	return u.UnixConn.RemoteAddr()
 }
 
+// Close shuts down the read side as well so a blocked Accept returns.
 func (u *UnixConnListener) Close() error {
+	u.UnixConn.CloseRead()
 	return u.UnixConn.Close()
 }
 
 func (u *UnixConnListener) Accept() (net.Conn, error) {
-	file, err := Get(u.UnixConn, "remote")
+	viaf, err := u.UnixConn.File()
 	if err != nil {
-		return nil, fmt.Errorf("UnixConnListener: err: fd.Get: %v: %v->%v", err, u.UnixConn.LocalAddr(), u.UnixConn.RemoteAddr())
+		return nil, fmt.Errorf("UnixConnListener: err: file: %v", err)
 	}
+	defer viaf.Close()
 
-	defer file.Close()
-	fc, err := net.FileConn(file)
-	if err != nil {
-		return nil, fmt.Errorf("UnixConnListener: err: fileconn: %v", err)
-	}
+	for {
+		m, err := ReadMsg(int(viaf.Fd()), "remote")
+		if err != nil {
+			return nil, fmt.Errorf("UnixConnListener: err: fd.Get: %w: %v->%v", err, u.UnixConn.LocalAddr(), u.UnixConn.RemoteAddr())
+		}
 
-	return fc, nil
+		switch m.Type {
+		case MsgFd:
+			if m.File == nil {
+				return nil, fmt.Errorf("UnixConnListener: err: no fd in message")
+			}
+			defer m.File.Close()
+			fc, err := net.FileConn(m.File)
+			if err != nil {
+				return nil, fmt.Errorf("UnixConnListener: err: fileconn: %v", err)
+			}
+			meta, err := m.Meta()
+			if err != nil {
+				fc.Close()
+				return nil, fmt.Errorf("UnixConnListener: err: %v", err)
+			}
+			if meta != nil {
+				return &PeerConn{Conn: fc, Meta: *meta}, nil
+			}
+			return fc, nil
+		case MsgDrain:
+			timeout, err := m.Timeout()
+			if err != nil {
+				return nil, err
+			}
+			if u.OnDrain != nil {
+				u.OnDrain(timeout)
+			}
+			return nil, ErrDraining
+		case MsgListener:
+			if u.OnListener != nil {
+				u.OnListener(m.File)
+			} else if m.File != nil {
+				m.File.Close()
+			}
+		case MsgReload:
+			if u.OnReload != nil {
+				u.OnReload()
+			}
+		default:
+			if m.File != nil {
+				m.File.Close()
+			}
+		}
+	}
 }
 
-func Get(via *net.UnixConn, filename string) (*os.File, error) {
+func Get(via *net.UnixConn, filename string) (*os.File, *ConnMeta, error) {
 	viaf, err := via.File()
 	if err != nil {
-		return nil, fmt.Errorf("file: %v", err)
+		return nil, nil, fmt.Errorf("file: %v", err)
 	}
 	defer viaf.Close()
 	return GetFd(int(viaf.Fd()), filename)
 }
 
-func GetFd(fd int, filename string) (*os.File, error) {
-	// recvmsg
-	buf := make([]byte, syscall.CmsgSpace(4))
-	_, _, _, _, err := syscall.Recvmsg(fd, nil, buf, 0)
+func GetFd(fd int, filename string) (*os.File, *ConnMeta, error) {
+	m, err := ReadMsg(fd, filename)
 	if err != nil {
-		return nil, fmt.Errorf("recvmsg: %v", err)
+		return nil, nil, err
 	}
 
-	// parse control msgs
-	msgs, err := syscall.ParseSocketControlMessage(buf)
-	if err != nil {
-		return nil, fmt.Errorf("parsesocketcontrolmessage: %v, %d", err, fd)
+	if m.Type != MsgFd || m.File == nil {
+		if m.File != nil {
+			m.File.Close()
+		}
+		return nil, nil, fmt.Errorf("expected fd, got message %d", m.Type)
 	}
 
-	fds, err := syscall.ParseUnixRights(&msgs[0])
+	meta, err := m.Meta()
 	if err != nil {
-		return nil, fmt.Errorf("parseunixrights: %v", err)
+		m.File.Close()
+		return nil, nil, err
 	}
-	// convert fds to files
-	return os.NewFile(uintptr(fds[0]), filename), nil
+	return m.File, meta, nil
 }
 
-func Put(via *net.UnixConn, file *os.File) error {
+func Put(via *net.UnixConn, file *os.File, meta *ConnMeta) error {
 	viaf, err := via.File()
 	if err != nil {
 		return err
 	}
 	defer viaf.Close()
-	return PutFd(int(viaf.Fd()), file)
+	return PutFd(int(viaf.Fd()), file, meta)
 }
 
-func PutFd(fd int, file *os.File) error {
-	rights := syscall.UnixRights(int(file.Fd()))
-	n, err := syscall.SendmsgN(fd, nil, rights, nil, 0)
+// PutFd passes file over fd, with meta if it's set.
+func PutFd(fd int, file *os.File, meta *ConnMeta) error {
+	m, err := FdMsg(file, meta)
 	if err != nil {
 		return err
 	}
-
-	if n != 0 {
-		return fmt.Errorf("n(%d) != 0", n)
-	}
-	return nil
+	return WriteMsg(fd, m)
 }
 
 func CopyUnix(dst, src net.Conn) (err error) {
@@ -136,19 +186,21 @@ func CopyUnix(dst, src net.Conn) (err error) {
 		to = d
 	}
 
+	p := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
 	for {
-		p := make([]byte, 0)
-		oob := make([]byte, 24)
-		_, _, _, _, err = from.ReadMsgUnix(p, oob)
+		n, oobn, _, _, err := from.ReadMsgUnix(p, oob)
 		if err != nil {
-			return
+			return err
+		}
+		if n == 0 && oobn == 0 {
+			return nil
 		}
 
-		_, _, err = to.WriteMsgUnix(p, oob, nil)
+		_, _, err = to.WriteMsgUnix(p[:n], oob[:oobn], nil)
 		if err != nil {
-			return
+			return err
 		}
-
 	}
 }
 
@@ -183,17 +235,9 @@ type Dialer struct {
 func (d *Dialer) DialContext(ctx context.Context, protocol string, addr string) (conn net.Conn, err error) {
 	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
 	defer cancel()
-	dialer := &net.Dialer{}
-	if d.NetNs != nil {
-		dialer, err = d.NetNs.Dialer(d.SourceIP, d.Timeout)
-		if err != nil {
-			return nil, err
-		}
-	}
-	if d.TLSConfig != nil {
-		conn, err = tls.DialWithDialer(dialer, protocol, addr, d.TLSConfig)
-	} else {
-		conn, err = dialer.DialContext(ctx, protocol, addr)
+	conn, err = d.Dial(ctx, protocol, addr)
+	if err == nil && d.TLSConfig != nil {
+		conn, err = d.handshake(ctx, conn, addr)
 	}
 
 	if err != nil {
@@ -204,3 +248,57 @@ func (d *Dialer) DialContext(ctx context.Context, protocol string, addr string)
 
 	return
 }
+
+// Dial connects to addr from the namespace, without TLS.
+func (d *Dialer) Dial(ctx context.Context, protocol string, addr string) (conn net.Conn, err error) {
+	if d.NetNs == nil {
+		return (&net.Dialer{}).DialContext(ctx, protocol, addr)
+	}
+	dialer, err := d.NetNs.Dialer(d.SourceIP, d.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := d.NetNs.resolve(ctx, protocol, addr)
+	if err != nil {
+		return nil, err
+	}
+	// One literal address at a time, the Dialer would race IPv4 and
+	// IPv6 on goroutines of its own, outside of Do.
+	var first error
+	for _, addr := range addrs {
+		if nerr := d.NetNs.Do(func() error {
+			conn, err = dialer.DialContext(ctx, protocol, addr)
+			return err
+		}); err == nil {
+			err = nerr
+		}
+		if err == nil {
+			return conn, nil
+		}
+		if first == nil {
+			first = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, first
+}
+
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	config := d.TLSConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TestDialerNetNs listens on loopback in a new namespace, which the
+// dial only reaches from a socket created in it.
+func TestDialerNetNs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create namespaces")
+	}
+
+	ln, h := func() (net.Listener, netns.NsHandle) {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		origin, err := netns.Get()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer origin.Close()
+		h, err := netns.New()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer netns.Set(origin)
+		if err := exec.Command("ip", "link", "set", "lo", "up").Run(); err != nil {
+			t.Fatalf("lo up: %v", err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return ln, h
+	}()
+	defer h.Close()
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	n := &NetworkNamespace{Path: fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), h), Ctx: context.Background()}
+	n.SetCurrent()
+	defer n.Close()
+	conn, err := (&Dialer{NetNs: n, Timeout: 5 * time.Second}).DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	buf, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q: %v", buf, err)
+	}
+}
+
+// TestDialerNetNsName dials a name that only the namespace resolves,
+// to an IPv6 address nothing listens on and an IPv4 one.
+func TestDialerNetNsName(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create namespaces")
+	}
+
+	n := &NetworkNamespace{Create: true, Protocol: "tcp", Ctx: context.Background()}
+	n.SetCurrent()
+	defer n.Close()
+	defer n.Remove()
+	nsDNS(t, n, map[string][]net.IP{"backend.gopipe.test.": {net.ParseIP("::1"), net.ParseIP("127.0.0.1")}})
+
+	var ln net.Listener
+	if err := n.Do(func() (err error) {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		return
+	}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := (&Dialer{NetNs: n, Timeout: 5 * time.Second}).DialContext(context.Background(), "tcp", net.JoinHostPort("backend.gopipe.test", port))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	buf, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q: %v", buf, err)
+	}
+}
+
+// nsDNS answers names with ips inside n, on the address of the first
+// nameserver in /etc/resolv.conf. The one of the host doesn't know them.
+func nsDNS(t *testing.T, n *NetworkNamespace, names map[string][]net.IP) {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		t.Skipf("%v", err)
+	}
+	var server net.IP
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[0] == "nameserver" {
+			server = net.ParseIP(f[1])
+			break
+		}
+	}
+	if server == nil {
+		t.Skip("no nameserver in /etc/resolv.conf")
+	}
+
+	var pc net.PacketConn
+	if err := n.Do(func() (err error) {
+		if !server.IsLoopback() {
+			lo, err := netlink.LinkByName("lo")
+			if err != nil {
+				return err
+			}
+			bits := len(server.To16()) * 8
+			if ip4 := server.To4(); ip4 != nil {
+				server, bits = ip4, 32
+			}
+			if err := netlink.AddrAdd(lo, &netlink.Addr{IPNet: &net.IPNet{IP: server, Mask: net.CIDRMask(bits, bits)}}); err != nil {
+				return err
+			}
+		}
+		pc, err = net.ListenPacket("udp", net.JoinHostPort(server.String(), "53"))
+		return
+	}); err != nil {
+		t.Fatalf("dns: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go serveDNS(pc, names)
+}
+
+func serveDNS(pc net.PacketConn, names map[string][]net.IP) {
+	buf := make([]byte, 512)
+	for {
+		l, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:l])
+		if err != nil {
+			continue
+		}
+		q, err := p.Question()
+		if err != nil {
+			continue
+		}
+
+		ips, ok := names[q.Name.String()]
+		rcode := dnsmessage.RCodeSuccess
+		if !ok {
+			rcode = dnsmessage.RCodeNameError
+		}
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RCode: rcode})
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		for _, ip := range ips {
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+				b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip4)})
+			} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+				b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+			}
+		}
+		if msg, err := b.Finish(); err == nil {
+			pc.WriteTo(msg, addr)
+		}
+	}
+}
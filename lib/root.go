@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// privateRoot pivots into an empty tmpfs with only the paths in read
+// bind mounted read-only and those in sockets writable, at the same
+// paths as before. It needs a mount namespace of its own.
+func privateRoot(read, sockets []string) (err error) {
+	type bind struct {
+		path string
+		fd   int
+		dir  bool
+		rw   bool
+	}
+	var binds []bind
+	defer func() {
+		for _, b := range binds {
+			unix.Close(b.fd)
+		}
+	}()
+	// Opened before the tmpfs hides anything, paths under it included.
+	open := func(path string, rw bool) error {
+		fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err == unix.ENOENT {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			unix.Close(fd)
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		binds = append(binds, bind{path: filepath.Clean(path), fd: fd, dir: st.Mode&unix.S_IFMT == unix.S_IFDIR, rw: rw})
+		return nil
+	}
+	for _, path := range read {
+		if err := open(path, false); err != nil {
+			return err
+		}
+	}
+	for _, path := range sockets {
+		if err := open(path, true); err != nil {
+			return err
+		}
+	}
+
+	// Nothing done here may show up in the namespace we came from.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make / private: %v", err)
+	}
+	root := os.TempDir()
+	if err := unix.Mount("tmpfs", root, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755,size=1m"); err != nil {
+		return fmt.Errorf("tmpfs: %v", err)
+	}
+	pivoted := false
+	defer func() {
+		// Don't hide anything a chroot needs.
+		if err != nil && !pivoted {
+			unix.Unmount(root, unix.MNT_DETACH)
+		}
+	}()
+
+	for _, b := range binds {
+		target := filepath.Join(root, b.path)
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if b.dir {
+				err = os.Mkdir(target, 0755)
+			} else {
+				err = os.WriteFile(target, nil, 0600)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := unix.Mount(fmt.Sprintf("/proc/self/fd/%d", b.fd), target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %v", b.path, err)
+		}
+		if b.rw {
+			continue
+		}
+		if err := unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, ""); err != nil {
+			return fmt.Errorf("read-only %s: %v", b.path, err)
+		}
+	}
+
+	old := filepath.Join(root, ".oldroot")
+	if err := os.Mkdir(old, 0700); err != nil {
+		return err
+	}
+	if err := unix.PivotRoot(root, old); err != nil {
+		return fmt.Errorf("pivot_root: %v", err)
+	}
+	pivoted = true
+	if err := unix.Chdir("/"); err != nil {
+		return err
+	}
+	if err := unix.Unmount("/.oldroot", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount old root: %v", err)
+	}
+	if err := os.Remove("/.oldroot"); err != nil {
+		return err
+	}
+	if err := unix.Mount("", "/", "", unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("read-only /: %v", err)
+	}
+	return nil
+}
+
+func chroot(dir string) error {
+	if err := unix.Chroot(dir); err != nil {
+		return fmt.Errorf("chroot %s: %v", dir, err)
+	}
+	return unix.Chdir("/")
+}
+
+// enterRoot moves a forked child into its private root, or into its
+// chroot if that fails or is all that was asked for.
+func (c *Connection) enterRoot() error {
+	if c.PrivateRoot {
+		err := privateRoot(c.childPaths())
+		if err == nil || c.Chroot == "" {
+			return err
+		}
+		fmt.Printf("Warning: private root: %v, using chroot %s\n", err, c.Chroot)
+	}
+	if c.Chroot != "" {
+		return chroot(c.Chroot)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPrivateRoot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root for a mount namespace")
+	}
+
+	// The root is changed in a copy of the test, in a mount namespace
+	// of its own.
+	if dir := os.Getenv("GOPIPE_TEST_PRIVATE_ROOT"); dir != "" {
+		allowed, denied, sockets := filepath.Join(dir, "allowed"), filepath.Join(dir, "denied"), filepath.Join(dir, "sockets")
+		if err := privateRoot([]string{allowed}, []string{sockets}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := os.ReadFile(allowed); err != nil {
+			t.Errorf("%v", err)
+		}
+		if err := os.WriteFile(allowed, nil, 0600); !errors.Is(err, syscall.EROFS) {
+			t.Errorf("write %s: %v", allowed, err)
+		}
+		if _, err := os.Stat(denied); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("stat %s: %v", denied, err)
+		}
+		if err := os.WriteFile(filepath.Join(sockets, "s"), nil, 0600); err != nil {
+			t.Errorf("%v", err)
+		}
+		if _, err := os.Stat("/etc"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("stat /etc: %v", err)
+		}
+		return
+	}
+
+	dir := t.TempDir()
+	for _, f := range []string{"allowed", "denied"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(f), 0600); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sockets"), 0700); err != nil {
+		t.Fatalf("%v", err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPrivateRoot$")
+	cmd.Env = append(os.Environ(), "GOPIPE_TEST_PRIVATE_ROOT="+dir)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	// Nothing done in the copy shows up here.
+	if _, err := os.Stat(filepath.Join(dir, "denied")); err != nil {
+		t.Errorf("%v", err)
+	}
+}
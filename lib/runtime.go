@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	tasks "github.com/containerd/containerd/api/services/tasks/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const runtimeTimeout = 5 * time.Second
+
+// getUnixHTTP does a GET of path on the API served on socket.
+func getUnixHTTP(ctx context.Context, socket, path string) (*http.Response, error) {
+	client := &http.Client{
+		Timeout: runtimeTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://d"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// getPodmanPid asks the libpod API on socket for the pid of a running
+// container.
+func getPodmanPid(ctx context.Context, socket, name string) (int, error) {
+	resp, err := getUnixHTTP(ctx, socket, "/v4.0.0/libpod/containers/"+url.PathEscape(name)+"/json")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var inspect struct {
+		Message string `json:"message"`
+		State   struct {
+			Running bool `json:"Running"`
+			Pid     int  `json:"Pid"`
+		} `json:"State"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return 0, fmt.Errorf("%s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", resp.Status, inspect.Message)
+	}
+	if !inspect.State.Running || inspect.State.Pid < 1 {
+		return 0, fmt.Errorf("%s is not running", name)
+	}
+	return inspect.State.Pid, nil
+}
+
+func dialRuntime(socket string) (*grpc.ClientConn, error) {
+	return grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+// getContainerdPid asks containerd on socket for the pid of the task of
+// a container in namespace.
+func getContainerdPid(ctx context.Context, socket, namespace, id string) (int, error) {
+	conn, err := dialRuntime(socket)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, runtimeTimeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "containerd-namespace", namespace)
+
+	resp, err := tasks.NewTasksClient(conn).Get(ctx, &tasks.GetRequest{ContainerID: id})
+	if err != nil {
+		return 0, err
+	}
+	if resp.Process == nil || resp.Process.Pid == 0 {
+		return 0, fmt.Errorf("%s has no running task", id)
+	}
+	return int(resp.Process.Pid), nil
+}
+
+// getCRISandbox finds a ready pod sandbox by name, or namespace/name,
+// and labels over the CRI on socket. The runtime tells us either the
+// pid of the sandbox or the path of its network namespace.
+func getCRISandbox(ctx context.Context, socket, pod string, labels []string) (pid int, path string, err error) {
+	selector := map[string]string{}
+	for _, l := range labels {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok {
+			return 0, "", fmt.Errorf("label %q is not key=value", l)
+		}
+		selector[k] = v
+	}
+	namespace, name, ok := strings.Cut(pod, "/")
+	if !ok {
+		namespace, name = "", pod
+	}
+
+	conn, err := dialRuntime(socket)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, runtimeTimeout)
+	defer cancel()
+	client := cri.NewRuntimeServiceClient(conn)
+
+	list, err := client.ListPodSandbox(ctx, &cri.ListPodSandboxRequest{Filter: &cri.PodSandboxFilter{
+		State:         &cri.PodSandboxStateValue{State: cri.PodSandboxState_SANDBOX_READY},
+		LabelSelector: selector,
+	}})
+	if err != nil {
+		return 0, "", err
+	}
+
+	var ids []string
+	for _, s := range list.Items {
+		if name != "" && (s.Metadata == nil || s.Metadata.Name != name || (namespace != "" && s.Metadata.Namespace != namespace)) {
+			continue
+		}
+		ids = append(ids, s.Id)
+	}
+	switch {
+	case len(ids) == 0:
+		return 0, "", fmt.Errorf("no ready pod sandbox found")
+	case len(ids) > 1:
+		return 0, "", fmt.Errorf("%d pod sandboxes found: %s", len(ids), strings.Join(ids, ", "))
+	}
+
+	status, err := client.PodSandboxStatus(ctx, &cri.PodSandboxStatusRequest{PodSandboxId: ids[0], Verbose: true})
+	if err != nil {
+		return 0, "", err
+	}
+
+	var info struct {
+		Pid         int `json:"pid"`
+		RuntimeSpec struct {
+			Linux struct {
+				Namespaces []struct {
+					Type string `json:"type"`
+					Path string `json:"path"`
+				} `json:"namespaces"`
+			} `json:"linux"`
+		} `json:"runtimeSpec"`
+	}
+	if err := json.Unmarshal([]byte(status.Info["info"]), &info); err != nil {
+		return 0, "", fmt.Errorf("sandbox %s: info: %v", ids[0], err)
+	}
+	if info.Pid > 0 {
+		return info.Pid, "", nil
+	}
+	for _, ns := range info.RuntimeSpec.Linux.Namespaces {
+		if ns.Type == "network" && ns.Path != "" {
+			return 0, ns.Path, nil
+		}
+	}
+	return 0, "", fmt.Errorf("sandbox %s: no pid or network namespace in info", ids[0])
+}
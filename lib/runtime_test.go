@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	tasks "github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func listenUnix(t *testing.T) (net.Listener, string) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln, socket
+}
+
+func TestPodmanPid(t *testing.T) {
+	ln, socket := listenUnix(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v4.0.0/libpod/containers/web/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"State":{"Running":true,"Pid":1234}}`)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"no such container"}`)
+	})
+	go http.Serve(ln, mux)
+
+	pid, err := getPodmanPid(context.Background(), socket, "web")
+	if err != nil || pid != 1234 {
+		t.Fatalf("pid(%d) != 1234: %v", pid, err)
+	}
+	if _, err := getPodmanPid(context.Background(), socket, "db"); err == nil {
+		t.Fatalf("found a pid for a missing container")
+	}
+}
+
+type fakeTasks struct {
+	tasks.UnimplementedTasksServer
+}
+
+func (fakeTasks) Get(ctx context.Context, req *tasks.GetRequest) (*tasks.GetResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ns := md.Get("containerd-namespace"); len(ns) != 1 || ns[0] != "k8s.io" || req.ContainerID != "web" {
+		return nil, fmt.Errorf("not found")
+	}
+	return &tasks.GetResponse{Process: &task.Process{ID: "web", Pid: 1234}}, nil
+}
+
+func TestContainerdPid(t *testing.T) {
+	ln, socket := listenUnix(t)
+	s := grpc.NewServer()
+	tasks.RegisterTasksServer(s, fakeTasks{})
+	go s.Serve(ln)
+	defer s.Stop()
+
+	pid, err := getContainerdPid(context.Background(), socket, "k8s.io", "web")
+	if err != nil || pid != 1234 {
+		t.Fatalf("pid(%d) != 1234: %v", pid, err)
+	}
+	if _, err := getContainerdPid(context.Background(), socket, "default", "web"); err == nil {
+		t.Fatalf("found a pid in the wrong namespace")
+	}
+}
+
+type fakeRuntime struct {
+	cri.UnimplementedRuntimeServiceServer
+}
+
+func (*fakeRuntime) ListPodSandbox(ctx context.Context, req *cri.ListPodSandboxRequest) (*cri.ListPodSandboxResponse, error) {
+	resp := &cri.ListPodSandboxResponse{}
+	for _, s := range []*cri.PodSandbox{
+		{Id: "a", Metadata: &cri.PodSandboxMetadata{Name: "web", Namespace: "prod"}, Labels: map[string]string{"app": "web"}},
+		{Id: "b", Metadata: &cri.PodSandboxMetadata{Name: "web", Namespace: "test"}, Labels: map[string]string{"app": "web"}},
+	} {
+		if v, ok := req.Filter.LabelSelector["app"]; ok && s.Labels["app"] != v {
+			continue
+		}
+		resp.Items = append(resp.Items, s)
+	}
+	return resp, nil
+}
+
+func (*fakeRuntime) PodSandboxStatus(ctx context.Context, req *cri.PodSandboxStatusRequest) (*cri.PodSandboxStatusResponse, error) {
+	info := map[string]string{
+		"a": `{"pid":1234}`,
+		"b": `{"runtimeSpec":{"linux":{"namespaces":[{"type":"pid"},{"type":"network","path":"/var/run/netns/cni-b"}]}}}`,
+	}
+	return &cri.PodSandboxStatusResponse{Info: map[string]string{"info": info[req.PodSandboxId]}}, nil
+}
+
+func TestCRISandbox(t *testing.T) {
+	ln, socket := listenUnix(t)
+	s := grpc.NewServer()
+	cri.RegisterRuntimeServiceServer(s, &fakeRuntime{})
+	go s.Serve(ln)
+	defer s.Stop()
+
+	ctx := context.Background()
+	if pid, _, err := getCRISandbox(ctx, socket, "prod/web", nil); err != nil || pid != 1234 {
+		t.Fatalf("pid(%d) != 1234: %v", pid, err)
+	}
+	if _, path, err := getCRISandbox(ctx, socket, "test/web", []string{"app=web"}); err != nil || path != "/var/run/netns/cni-b" {
+		t.Fatalf("path(%s) != /var/run/netns/cni-b: %v", path, err)
+	}
+	if _, _, err := getCRISandbox(ctx, socket, "web", nil); err == nil {
+		t.Fatalf("picked one of two sandboxes named web")
+	}
+	if _, _, err := getCRISandbox(ctx, socket, "", []string{"app=db"}); err == nil {
+		t.Fatalf("found a sandbox for app=db")
+	}
+}
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	seccomp "github.com/elastic/go-seccomp-bpf"
+	"github.com/elastic/go-seccomp-bpf/arch"
+)
+
+// seccompBase is allowed in every forked child: what the Go runtime
+// needs, moving bytes between sockets and messages with the parent.
+var seccompBase = []string{
+	"arch_prctl", "brk", "clock_gettime", "clock_nanosleep", "clone", "clone3", "close",
+	"dup", "dup3", "epoll_create1", "epoll_ctl", "epoll_pwait", "epoll_wait", "eventfd2",
+	"exit", "exit_group", "fcntl", "fstat", "futex", "getgid", "getpeername", "getpid",
+	"getrandom", "getrlimit", "getsockname", "getsockopt", "gettid", "getuid", "madvise",
+	"mmap", "mprotect", "munmap", "nanosleep", "pipe2", "prlimit64", "read", "readv",
+	"recvfrom", "recvmsg", "restart_syscall", "rseq", "rt_sigaction", "rt_sigprocmask",
+	"rt_sigreturn", "sched_getaffinity", "sched_yield", "sendmsg", "sendto",
+	"set_robust_list", "setsockopt", "shutdown", "sigaltstack", "splice", "tgkill",
+	"write", "writev",
+}
+
+// seccompRoles is added to seccompBase for each kind of child. A
+// fd-passer only accepts on a listener it was handed and passes the
+// connections on, a listener binds itself and terminates TLS, a client
+// resolves and dials.
+var seccompRoles = map[string][]string{
+	"fd-passer": {"accept", "accept4"},
+	"listen": {"accept", "accept4", "bind", "listen", "socket", "socketpair",
+		// Reading /proc/sys/net/core/somaxconn.
+		"openat"},
+	"client": {"bind", "connect", "socket", "socketpair",
+		// Reading /etc/resolv.conf and /etc/hosts.
+		"lseek", "newfstatat", "openat", "uname"},
+}
+
+// SeccompProfile is a custom allow-list, loaded instead of the one of
+// the role.
+type SeccompProfile struct {
+	Syscalls []string `json:"syscalls"`
+}
+
+func readSeccompProfile(path string) (*SeccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &SeccompProfile{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(p.Syscalls) == 0 {
+		return nil, fmt.Errorf("%s: no syscalls", path)
+	}
+	return p, nil
+}
+
+// seccompPolicy allows the syscalls of role, or those in profile if
+// set. Others are logged or kill the process, depending on action.
+func seccompPolicy(action, role, profile string) (*seccomp.Policy, error) {
+	var syscalls []string
+	if profile != "" {
+		p, err := readSeccompProfile(profile)
+		if err != nil {
+			return nil, err
+		}
+		syscalls = p.Syscalls
+	} else {
+		extra, ok := seccompRoles[role]
+		if !ok {
+			return nil, fmt.Errorf("no seccomp profile for %s", role)
+		}
+		// Not every architecture has all of them, e.g. arm64 has no
+		// epoll_wait.
+		info, err := arch.GetInfo("")
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range append(append([]string{}, seccompBase...), extra...) {
+			if _, ok := info.SyscallNames[name]; ok {
+				syscalls = append(syscalls, name)
+			}
+		}
+	}
+
+	policy := &seccomp.Policy{
+		Syscalls: []seccomp.SyscallGroup{{Action: seccomp.ActionAllow, Names: syscalls}},
+	}
+	switch action {
+	case "log":
+		policy.DefaultAction = seccomp.ActionLog
+	case "kill":
+		policy.DefaultAction = seccomp.ActionKillProcess
+	default:
+		return nil, fmt.Errorf("unknown seccomp action %q", action)
+	}
+	if _, err := policy.Assemble(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// loadSeccomp installs the filter on all threads of the process, it
+// can't be removed again.
+func loadSeccomp(policy *seccomp.Policy) error {
+	if !seccomp.Supported() {
+		return fmt.Errorf("seccomp is not supported")
+	}
+	return seccomp.LoadFilter(seccomp.Filter{
+		NoNewPrivs: true,
+		Flag:       seccomp.FilterFlagTSync | seccomp.FilterFlagLog,
+		Policy:     *policy,
+	})
+}
+
+// seccompRole tells what kind of forked child the connection runs.
+func (c *Connection) seccompRole() (string, error) {
+	switch c.Mode {
+	case "UnixDial":
+		return "client", nil
+	case "UnixSend":
+		if c.Listen.inherited != nil && c.Listen.TLS.config == nil {
+			return "fd-passer", nil
+		}
+		return "listen", nil
+	}
+	return "", fmt.Errorf("--seccomp is only for forked children, not %s", c.Mode)
+}
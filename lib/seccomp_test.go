@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeccompPolicy(t *testing.T) {
+	for _, role := range []string{"fd-passer", "listen", "client"} {
+		if _, err := seccompPolicy("kill", role, ""); err != nil {
+			t.Errorf("%s: %v", role, err)
+		}
+	}
+
+	profile := filepath.Join(t.TempDir(), "profile.json")
+	if err := os.WriteFile(profile, []byte(`{"syscalls": ["read", "write", "exit_group"]}`), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	policy, err := seccompPolicy("log", "listen", profile)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if names := policy.Syscalls[0].Names; len(names) != 3 {
+		t.Errorf("custom profile not used: %v", names)
+	}
+
+	if err := os.WriteFile(profile, []byte(`{"syscalls": ["no_such_syscall"]}`), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := seccompPolicy("log", "listen", profile); err == nil {
+		t.Errorf("unknown syscall accepted")
+	}
+	if _, err := seccompPolicy("log", "parent", ""); err == nil {
+		t.Errorf("policy for unknown role")
+	}
+}
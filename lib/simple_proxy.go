@@ -2,68 +2,46 @@ package lib
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 type SimpleProxy struct {
 	SetupCtxCancel context.CancelFunc
 	Ln             net.Listener
+	draining       atomic.Bool
 }
 
-func (s *SimpleProxy) listen(l *Listen) (ln net.Listener, err error) {
-	if l.IsFd() {
-		ln, err = l.GetListener(l.TLS.config)
-		if err != nil {
-			return
-		}
-	} else {
-		ln, err = net.Listen(l.Protocol, l.GetAddr())
-		if err != nil {
-			return
-		}
-	}
+func (s *SimpleProxy) dial(c *Client) (net.Conn, error) {
+	return (&Dialer{
+		NetNs:     &c.NetNs,
+		Timeout:   c.Timeout,
+		TLSConfig: c.TLS.config,
+		SourceIP:  c.SourceIP,
+	}).DialContext(c.Ctx, c.Protocol, c.GetAddr())
+}
 
-	if l.TLS.config != nil {
-		ln = tls.NewListener(ln, l.TLS.config)
+func (s *SimpleProxy) Close() (err error) {
+	if s.Ln == nil {
+		return nil
 	}
-
-	return
+	return s.Ln.Close()
 }
 
-func (s *SimpleProxy) dial(c *Client) (conn net.Conn, err error) {
-	ctx, cancel := context.WithTimeout(c.Ctx, c.Timeout)
-	defer cancel()
-	dialer, err := c.NetNs.Dialer(c.SourceIP, c.Timeout)
-	if err != nil {
-		return nil, err
-	}
-	if c.TLS.config != nil {
-		conn, err = tls.DialWithDialer(dialer, c.Protocol, c.GetAddr(), c.TLS.config)
-	} else {
-		conn, err = dialer.DialContext(ctx, c.Protocol, c.GetAddr())
+func (s *SimpleProxy) Drain(timeout time.Duration) error {
+	if s.draining.Swap(true) {
+		return nil
 	}
-
-	if err != nil {
-		/*		if !triedAgain {
-				triedAgain = true
-				goto again
-			}*/
-		if err == io.EOF {
-			err = nil
-		}
+	if s.Ln == nil {
+		return nil
 	}
-
-	return
-}
-
-func (s *SimpleProxy) Close() (err error) {
 	return s.Ln.Close()
 }
+
 func (s *SimpleProxy) Proxy(l *Listen, c *Client) (err error) {
-	s.Ln, err = s.listen(l)
+	s.Ln, err = l.Listener()
 	if err != nil {
 		if s.SetupCtxCancel != nil {
 			s.SetupCtxCancel()
@@ -73,10 +51,13 @@ func (s *SimpleProxy) Proxy(l *Listen, c *Client) (err error) {
 	if s.SetupCtxCancel != nil {
 		s.SetupCtxCancel()
 	}
-	var src, dst net.Conn
 	for {
-		if src, err = s.Ln.Accept(); err != nil {
-			return
+		src, err := s.Ln.Accept()
+		if err != nil {
+			if s.draining.Load() {
+				return nil
+			}
+			return err
 		}
 
 		go func() {
@@ -85,21 +66,12 @@ func (s *SimpleProxy) Proxy(l *Listen, c *Client) (err error) {
 					fmt.Printf("unable to close: %v\n", err)
 				}
 			}()
-			if dst, err = s.dial(c); err != nil {
+			dst, err := s.dial(c)
+			if err != nil {
 				fmt.Printf("unable to dial: %v\n", err)
 				return
 			}
-			src = &CloseWriter{src}
-			go func() {
-				defer func() {
-					cw := &CloseWriter{dst}
-					if err := cw.Close(); err != nil {
-						fmt.Printf("unable to close: %v\n", err)
-					}
-				}()
-				io.Copy(dst, src)
-			}()
-			io.Copy(src, dst)
+			l.conns.Pipe(0, src, dst)
 		}()
 	}
 }
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Supervisor decides if a forked child that exited is started again.
+type Supervisor struct {
+	Policy     string
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Max        int
+	Window     time.Duration
+
+	restarts []time.Time
+	backoff  time.Duration
+}
+
+func (p *Proc) supervisor() *Supervisor {
+	if p == nil {
+		return &Supervisor{Policy: "never"}
+	}
+	return &Supervisor{
+		Policy:     p.Restart,
+		Backoff:    p.RestartBackoff,
+		MaxBackoff: p.RestartMaxBackoff,
+		Max:        p.RestartMax,
+		Window:     p.RestartWindow,
+	}
+}
+
+// Next tells if a child that ran for ran and exited with err is started
+// again, and how long to wait before. The wait doubles with each restart
+// unless the child ran for a window. It gives up with an error once the
+// child has been restarted Max times within a window.
+func (s *Supervisor) Next(err error, ran time.Duration, now time.Time) (time.Duration, bool, error) {
+	switch s.Policy {
+	case "always":
+	case "on-failure":
+		if err == nil {
+			return 0, false, nil
+		}
+	default:
+		return 0, false, err
+	}
+
+	restarts := s.restarts[:0]
+	for _, t := range s.restarts {
+		if now.Sub(t) < s.Window {
+			restarts = append(restarts, t)
+		}
+	}
+	s.restarts = restarts
+	if s.Max > 0 && len(s.restarts) >= s.Max {
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		return 0, false, fmt.Errorf("restarted %d times within %s, giving up: %v", len(s.restarts), s.Window, err)
+	}
+	s.restarts = append(s.restarts, now)
+
+	if s.backoff == 0 || ran >= s.Window {
+		s.backoff = s.Backoff
+	} else {
+		s.backoff = min(2*s.backoff, s.MaxBackoff)
+	}
+	return s.backoff, true, nil
+}
+
+// exitError describes how a child exited, with what it wrote to stderr
+// if that was kept.
+func exitError(err error) error {
+	if err, ok := err.(*exec.ExitError); ok && len(err.Stderr) > 0 {
+		return fmt.Errorf("%v, %s", err, err.Stderr)
+	}
+	return err
+}
+
+// sleepContext waits for d, it tells false if ctx was done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSupervisorNext(t *testing.T) {
+	failed := errors.New("exit status 1")
+	now := time.Now()
+
+	s := &Supervisor{Policy: "never"}
+	if _, restart, err := s.Next(failed, time.Second, now); restart || err != failed {
+		t.Errorf("never restarted: %v %v", restart, err)
+	}
+
+	s = &Supervisor{Policy: "on-failure", Backoff: time.Second, MaxBackoff: 3 * time.Second, Max: 4, Window: time.Minute}
+	if _, restart, err := s.Next(nil, time.Second, now); restart || err != nil {
+		t.Errorf("on-failure restarted on a clean exit: %v %v", restart, err)
+	}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		delay, restart, err := s.Next(failed, time.Second, now.Add(time.Duration(i)*time.Second))
+		if !restart || err != nil || delay != want {
+			t.Errorf("restart %d: %s %v %v, want %s", i, delay, restart, err, want)
+		}
+	}
+	if _, restart, err := s.Next(failed, time.Second, now.Add(5*time.Second)); restart || err == nil {
+		t.Errorf("restarted more than max within the window")
+	}
+	// Once the window has passed it's restarted again, a child that ran
+	// for a window starts over with the shortest backoff.
+	delay, restart, err := s.Next(failed, time.Minute, now.Add(2*time.Minute))
+	if !restart || err != nil || delay != time.Second {
+		t.Errorf("after the window: %s %v %v", delay, restart, err)
+	}
+
+	s = &Supervisor{Policy: "always", Backoff: time.Second, MaxBackoff: time.Second, Window: time.Minute}
+	for i := 0; i < 10; i++ {
+		if _, restart, err := s.Next(nil, 0, now); !restart || err != nil {
+			t.Errorf("always without max gave up: %v", err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connID is shared by all trackers so that ids are unique per process.
+var connID atomic.Uint64
+
+type ConnStats struct {
+	ID         uint64    `json:"id"`
+	Connection string    `json:"connection"`
+	Local      string    `json:"local"`
+	Remote     string    `json:"remote"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Started    time.Time `json:"started"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	// Meta is what the process that accepted it passed on with it.
+	Meta *ConnMeta `json:"meta,omitempty"`
+}
+
+type trackedConn struct {
+	id       uint64
+	meta     *ConnMeta
+	src      net.Conn
+	dst      net.Conn
+	started  time.Time
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+type countWriter struct {
+	io.Writer
+	n *atomic.Uint64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.n.Add(uint64(n))
+	return n, err
+}
+
+// Tracker keeps the proxied connections of one Connection so they
+// can be listed and closed through the admin socket.
+type Tracker struct {
+	Name string
+
+	mu       sync.Mutex
+	conns    map[uint64]*trackedConn
+	accepted atomic.Uint64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	// remote counts connections active in forked children, last is
+	// when a connection was last accepted or closed.
+	remote atomic.Int64
+	last   atomic.Int64
+
+	// OnChange is called when a connection is added or removed.
+	OnChange func()
+}
+
+func NewTracker(name string) *Tracker {
+	t := &Tracker{Name: name, conns: map[uint64]*trackedConn{}}
+	t.touch()
+	return t
+}
+
+func (t *Tracker) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+func (t *Tracker) add(id uint64, src, dst net.Conn) *trackedConn {
+	tc := &trackedConn{
+		id:      id,
+		src:     src,
+		dst:     dst,
+		started: time.Now(),
+	}
+	if pc, ok := src.(*PeerConn); ok {
+		tc.meta = &pc.Meta
+	}
+	t.mu.Lock()
+	t.conns[tc.id] = tc
+	t.mu.Unlock()
+	t.touch()
+	if t.OnChange != nil {
+		t.OnChange()
+	}
+	return tc
+}
+
+func (t *Tracker) remove(tc *trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, tc.id)
+	t.bytesIn.Add(tc.bytesIn.Load())
+	t.bytesOut.Add(tc.bytesOut.Load())
+	t.mu.Unlock()
+	t.touch()
+	if t.OnChange != nil {
+		t.OnChange()
+	}
+}
+
+// Accepted counts a connection and returns its id. Pipe is given the
+// id if it copies it, else it is handled outside of this process, e.g.
+// passed on to a forked child.
+func (t *Tracker) Accepted() uint64 {
+	id := connID.Add(1)
+	if t == nil {
+		return id
+	}
+	t.accepted.Add(1)
+	t.touch()
+	return id
+}
+
+// AddRemote adjusts the number of connections active in forked children.
+func (t *Tracker) AddRemote(delta int) {
+	if t == nil || delta == 0 {
+		return
+	}
+	t.remote.Add(int64(delta))
+	t.touch()
+}
+
+// Pipe copies between src and dst until dst stops sending.
+// dst is closed when src stops sending, src is left to the caller.
+// id is from Accepted, 0 counts src as accepted here.
+func (t *Tracker) Pipe(id uint64, src, dst net.Conn) {
+	if t == nil {
+		t = NewTracker("")
+	}
+	if id == 0 {
+		id = t.Accepted()
+	}
+	tc := t.add(id, src, dst)
+	defer t.remove(tc)
+
+	src = &CloseWriter{src}
+	go func() {
+		defer func() {
+			cw := &CloseWriter{dst}
+			if err := cw.Close(); err != nil {
+				fmt.Printf("unable to close: %v\n", err)
+			}
+		}()
+		io.Copy(&countWriter{dst, &tc.bytesIn}, src)
+	}()
+	io.Copy(&countWriter{src, &tc.bytesOut}, dst)
+}
+
+func (t *Tracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns) + int(t.remote.Load())
+}
+
+// Idle returns how long there have been no active connections.
+func (t *Tracker) Idle() time.Duration {
+	if t.Active() > 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, t.last.Load()))
+}
+
+func (t *Tracker) Conns() (stats []ConnStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tc := range t.conns {
+		s := ConnStats{
+			ID:         tc.id,
+			Connection: t.Name,
+			Local:      tc.src.LocalAddr().String(),
+			Remote:     tc.src.RemoteAddr().String(),
+			Started:    tc.started,
+			BytesIn:    tc.bytesIn.Load(),
+			BytesOut:   tc.bytesOut.Load(),
+			Meta:       tc.meta,
+		}
+		if tc.dst != nil {
+			s.Upstream = tc.dst.RemoteAddr().String()
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return
+}
+
+// Kill closes both ends of the connection with the given id.
+func (t *Tracker) Kill(id uint64) bool {
+	t.mu.Lock()
+	tc, ok := t.conns[id]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	tc.src.Close()
+	if tc.dst != nil {
+		tc.dst.Close()
+	}
+	return true
+}
+
+// Totals returns the number of accepted connections and the bytes
+// copied in each direction, including connections still running.
+func (t *Tracker) Totals() (accepted, bytesIn, bytesOut uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	accepted, bytesIn, bytesOut = t.accepted.Load(), t.bytesIn.Load(), t.bytesOut.Load()
+	for _, tc := range t.conns {
+		bytesIn += tc.bytesIn.Load()
+		bytesOut += tc.bytesOut.Load()
+	}
+	return
+}
+
+// Wait blocks until there are no active connections or deadline passes.
+func (t *Tracker) Wait(deadline time.Time) bool {
+	for t.Active() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+func (t *Tracker) CloseAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tc := range t.conns {
+		tc.src.Close()
+		if tc.dst != nil {
+			tc.dst.Close()
+		}
+	}
+}
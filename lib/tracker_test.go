@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTrackerIdle(t *testing.T) {
+	tracker := NewTracker("idle")
+
+	tracker.AddRemote(2)
+	if tracker.Idle() != 0 {
+		t.Fatalf("idle(%s) with active remote connections", tracker.Idle())
+	}
+	if tracker.Active() != 2 {
+		t.Fatalf("active(%d) != 2", tracker.Active())
+	}
+
+	tracker.AddRemote(-2)
+	time.Sleep(20 * time.Millisecond)
+	if idle := tracker.Idle(); idle < 20*time.Millisecond {
+		t.Fatalf("idle(%s) < 20ms", idle)
+	}
+}
+
+func TestTrackerMeta(t *testing.T) {
+	tracker := NewTracker("meta")
+	id := tracker.Accepted()
+	src, peer := net.Pipe()
+	defer peer.Close()
+	dst, upstream := net.Pipe()
+	defer upstream.Close()
+
+	meta := NewConnMeta(id, &PeerConn{Conn: src, Meta: ConnMeta{Network: "tcp", Remote: "192.0.2.1:40000", Local: "192.0.2.2:443"}})
+	if meta.ID != id {
+		t.Fatalf("meta id(%d) != %d", meta.ID, id)
+	}
+	pc := &PeerConn{Conn: src, Meta: ConnMeta{ID: 7, Network: "tcp", Remote: "192.0.2.1:40000", ServerName: "example.com"}}
+	done := make(chan struct{})
+	go func() {
+		tracker.Pipe(id, pc, dst)
+		close(done)
+	}()
+
+	var conns []ConnStats
+	for i := 0; i < 100 && len(conns) == 0; i++ {
+		conns = tracker.Conns()
+		time.Sleep(time.Millisecond)
+	}
+	if len(conns) != 1 || conns[0].ID != id || conns[0].Meta == nil || conns[0].Meta.ID != 7 || conns[0].Remote != "192.0.2.1:40000" {
+		t.Fatalf("conns %+v", conns)
+	}
+	if accepted, _, _ := tracker.Totals(); accepted != 1 {
+		t.Fatalf("accepted(%d) != 1", accepted)
+	}
+
+	upstream.Close()
+	<-done
+	if tracker.Active() != 0 {
+		t.Fatalf("active(%d) != 0", tracker.Active())
+	}
+}
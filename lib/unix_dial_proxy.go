@@ -1,19 +1,24 @@
 package lib
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type UnixDialProxy struct {
-	Ln net.Listener
+	Ln       net.Listener
+	mu       sync.Mutex
+	draining atomic.Bool
 }
 
-func (s *UnixDialProxy) listen(l *Listen) (ln net.Listener, err error) {
+func (s *UnixDialProxy) listen(l *Listen, c *Client) (ln net.Listener, err error) {
 	if !strings.HasPrefix(l.Addr.GetAddr(), "FD:") {
 		return nil, fmt.Errorf("addr not a fd: %v", l.Addr)
 	}
@@ -33,7 +38,23 @@ func (s *UnixDialProxy) listen(l *Listen) (ln net.Listener, err error) {
 		return nil, fmt.Errorf("unable to convert conn to unixconn")
 	}
 
-	return &UnixConnListener{uc}, nil
+	if l.ReportActive && l.conns != nil {
+		l.conns.OnChange = func() {
+			// Send the count while holding the lock so the last
+			// message the parent reads is the current count.
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if err := WriteMsgConn(uc, ActiveMsg(l.conns.Active())); err != nil && l.Debug {
+				fmt.Printf("Error: %v\n", err)
+			}
+		}
+	}
+
+	return &UnixConnListener{UnixConn: uc, OnDrain: l.shutdown, OnReload: func() {
+		if err := c.TLS.Reload(); err != nil {
+			fmt.Printf("Error: reload: %v\n", err)
+		}
+	}}, nil
 }
 
 func (f *UnixDialProxy) dial(c *Client) (conn net.Conn, err error) {
@@ -46,20 +67,41 @@ func (f *UnixDialProxy) dial(c *Client) (conn net.Conn, err error) {
 }
 
 func (f *UnixDialProxy) Close() error {
+	if f.Ln == nil {
+		return nil
+	}
+	return f.Ln.Close()
+}
+
+func (f *UnixDialProxy) Drain(timeout time.Duration) error {
+	if f.draining.Swap(true) {
+		return nil
+	}
+	if f.Ln == nil {
+		return nil
+	}
 	return f.Ln.Close()
 }
 
 func (f *UnixDialProxy) Proxy(l *Listen, c *Client) (err error) {
-	f.Ln, err = f.listen(l)
+	f.Ln, err = f.listen(l, c)
 	if err != nil {
 		return
 	}
 
-	var src, dst net.Conn
-
 	for {
-		if src, err = f.Ln.Accept(); err != nil {
-			return
+		src, err := f.Ln.Accept()
+		if err != nil {
+			if errors.Is(err, ErrDraining) {
+				f.draining.Store(true)
+			}
+			if f.draining.Load() {
+				return nil
+			}
+			return err
+		}
+		if pc, ok := src.(*PeerConn); ok && l.Debug {
+			fmt.Printf("%s -> %s\n", &pc.Meta, c.GetAddr())
 		}
 
 		go func() {
@@ -68,22 +110,12 @@ func (f *UnixDialProxy) Proxy(l *Listen, c *Client) (err error) {
 					fmt.Printf("unable to close: %v\n", err)
 				}
 			}()
-			if dst, err = f.dial(c); err != nil {
+			dst, err := f.dial(c)
+			if err != nil {
 				fmt.Printf("unable to dial: %v\n", err)
 				return
 			}
-
-			src = &CloseWriter{src}
-			go func() {
-				defer func() {
-					cw := &CloseWriter{dst}
-					if err := cw.Close(); err != nil {
-						fmt.Printf("unable to close: %v\n", err)
-					}
-				}()
-				io.Copy(dst, src)
-			}()
-			io.Copy(src, dst)
+			l.conns.Pipe(0, src, dst)
 		}()
 	}
 }
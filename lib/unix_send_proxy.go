@@ -1,34 +1,26 @@
 package lib
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type UnixSendProxy struct {
-	Ln net.Listener
-}
-
-func (s *UnixSendProxy) listen(l *Listen) (ln net.Listener, err error) {
-	if l.IsFd() {
-		ln, err = l.GetListener(l.TLS.config)
-		if err != nil {
-			return
-		}
-	} else {
-		ln, err = net.Listen(l.Protocol, l.GetAddr())
-		if err != nil {
-			return
-		}
-	}
+	Ln       net.Listener
+	mu       sync.Mutex
+	draining atomic.Bool
+	timeout  atomic.Int64
+	sending  sync.WaitGroup
 
-	if l.TLS.config != nil {
-		ln = tls.NewListener(ln, l.TLS.config)
-	}
-
-	return
+	// Handshakes still going on when draining are given up.
+	handshakeCtx     context.Context
+	cancelHandshakes context.CancelFunc
 }
 
 /*
@@ -55,10 +47,131 @@ func (f *UnixSendProxy) send(c *Client, src net.Conn) (err error) {
 }*/
 
 func (f *UnixSendProxy) Close() error {
+	if f.Ln == nil {
+		return nil
+	}
 	return f.Ln.Close()
 }
+
+func (f *UnixSendProxy) Drain(timeout time.Duration) error {
+	f.timeout.Store(int64(timeout))
+	if f.draining.Swap(true) {
+		return nil
+	}
+	if f.Ln == nil {
+		return nil
+	}
+	return f.Ln.Close()
+}
+
+// write serializes messages on uc, both read and Proxy send on it.
+func (f *UnixSendProxy) write(uc int, m *Msg) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return WriteMsg(uc, m)
+}
+
+// read handles messages from the receiving side on uc, or from the
+// parent if it has a channel of its own, then uc is the receiving side
+// in a client child.
+func (f *UnixSendProxy) read(l *Listen, from, uc int) {
+	for {
+		m, err := ReadMsg(from, "remote")
+		if err != nil {
+			return
+		}
+		if m.File != nil {
+			m.File.Close()
+		}
+		if m.Type == MsgListener {
+			// The parent is upgrading and wants our listener, an
+			// empty reply tells it that there is none.
+			reply := &Msg{Type: MsgListener}
+			if reply.File, err = l.ListenerFile(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			if err := f.write(from, reply); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+			if reply.File != nil {
+				reply.File.Close()
+			}
+			continue
+		}
+		if m.Type == MsgReload {
+			if err := l.TLS.Reload(); err != nil {
+				fmt.Printf("Error: reload: %v\n", err)
+			}
+			if from != uc {
+				if err := f.write(uc, &Msg{Type: MsgReload}); err != nil {
+					fmt.Printf("Error: %v\n", err)
+				}
+			}
+			continue
+		}
+		if m.Type != MsgDrain {
+			continue
+		}
+		timeout, err := m.Timeout()
+		if err != nil {
+			continue
+		}
+		if l.shutdown != nil {
+			l.shutdown(timeout)
+		} else {
+			f.Drain(timeout)
+		}
+	}
+}
+
+func (f *UnixSendProxy) send(uc int, file *os.File, meta *ConnMeta) error {
+	m, err := FdMsg(file, meta)
+	if err != nil {
+		return err
+	}
+	return f.write(uc, m)
+}
+
+// sendTLS terminates TLS of t and passes the plain side on.
+func (f *UnixSendProxy) sendTLS(l *Listen, uc int, t *tls.Conn) {
+	defer f.sending.Done()
+	if err := t.HandshakeContext(f.handshakeCtx); err != nil {
+		if l.Debug {
+			fmt.Printf("Error: %s: handshake: %v\n", t.RemoteAddr(), err)
+		}
+		t.Close()
+		return
+	}
+	id := l.conns.Accepted()
+	meta := NewConnMeta(id, t)
+
+	conns, err := UnixPipe()
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		t.Close()
+		return
+	}
+	go func() {
+		l.conns.Pipe(id, t, conns[0])
+		(&CloseWriter{t}).Close()
+	}()
+	uf, err := conns[1].(*net.UnixConn).File()
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		conns[1].Close()
+		return
+	}
+	if err := f.send(uc, uf, meta); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+	uf.Close()
+	conns[1].Close()
+}
+
 func (f *UnixSendProxy) Proxy(l *Listen, c *Client) (err error) {
-	f.Ln, err = f.listen(l)
+	f.handshakeCtx, f.cancelHandshakes = context.WithCancel(l.Ctx)
+	defer f.cancelHandshakes()
+	f.Ln, err = l.Listener()
 	if err != nil {
 		return
 	}
@@ -67,45 +180,40 @@ func (f *UnixSendProxy) Proxy(l *Listen, c *Client) (err error) {
 	if err != nil {
 		return err
 	}
+	if l.control > 0 {
+		go f.read(l, l.control, uc)
+	} else {
+		go f.read(l, uc, uc)
+	}
+
 	var src net.Conn
 	for {
 		if src, err = f.Ln.Accept(); err != nil {
+			if f.draining.Load() {
+				// Tell the receiving side that nothing more is sent,
+				// once connections in their handshake are.
+				f.cancelHandshakes()
+				f.sending.Wait()
+				return f.write(uc, DrainMsg(time.Duration(f.timeout.Load())))
+			}
 			return
 		}
 
 		if t, ok := src.(*tls.Conn); ok {
-			p := &Pipe{}
-			conns, err := p.Unixpair()
-			if err != nil {
-				fmt.Printf("error: %v\n", err)
-				continue
-			}
-			go func() {
-				go func() {
-					io.Copy(conns[0], t)
-					(&CloseWriter{conns[0]}).Close()
-				}()
-				io.Copy(t, conns[0])
-				(&CloseWriter{t}).Close()
-			}()
-			uf, err := conns[1].(*net.UnixConn).File()
-			if err != nil {
-				fmt.Printf("error: %v\n", err)
-				continue
-			}
-			if err := PutFd(uc, uf); err != nil {
-				fmt.Printf("error: %v\n", err)
-				continue
-			}
+			// The handshake tells what goes with the connection.
+			f.sending.Add(1)
+			go f.sendTLS(l, uc, t)
 		} else {
+			id := l.conns.Accepted()
 			uf, err := src.(*net.TCPConn).File()
 			if err != nil {
 				continue
 			}
-			if err := PutFd(uc, uf); err != nil {
+			if err := f.send(uc, uf, NewConnMeta(id, src)); err != nil {
 				fmt.Printf("error: %v\n", err)
-				continue
 			}
+			uf.Close()
+			src.Close()
 		}
 	}
 }
@@ -0,0 +1,203 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// upgradeEnv names the fd of the channel an upgraded process gets its
+// listeners on.
+const upgradeEnv = "GOPIPE_UPGRADE_FD"
+
+// Handover is implemented by proxies whose listener lives in a forked
+// child and has to be fetched before it can be handed over.
+type Handover interface {
+	Listener() (*os.File, error)
+}
+
+// errNoListener is returned for connections that don't accept on a
+// listening socket, e.g. those passed in over a unix channel. The new
+// process sets them up itself.
+var errNoListener = errors.New("no listener to hand over")
+
+func (c *Connection) listenerFile() (*os.File, error) {
+	if h, ok := c.proxy.(Handover); ok {
+		return h.Listener()
+	}
+	return c.Listen.ListenerFile()
+}
+
+// Upgrader starts a new gopipe from os.Args and hands it the listeners
+// of all connections. Once the new process is accepting, OnReady is
+// called so that this process can drain.
+type Upgrader struct {
+	Connections []*Connection
+	Timeout     time.Duration
+	OnReady     func()
+
+	upgrading atomic.Bool
+	upgraded  atomic.Bool
+}
+
+// Upgraded reports whether a new process has taken over.
+func (u *Upgrader) Upgraded() bool {
+	return u.upgraded.Load()
+}
+
+func (u *Upgrader) Upgrade() (err error) {
+	if u.upgrading.Swap(true) {
+		return fmt.Errorf("upgrade: already upgrading")
+	}
+	defer func() {
+		if err != nil {
+			u.upgrading.Store(false)
+		}
+	}()
+
+	// files has the listener of each connection, nil for those without.
+	files := make([]*os.File, len(u.Connections))
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for i, c := range u.Connections {
+		f, err := c.listenerFile()
+		if errors.Is(err, errNoListener) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("upgrade: %s: %v", c.Name, err)
+		}
+		files[i] = f
+	}
+
+	conns, err := UnixPipe()
+	if err != nil {
+		return fmt.Errorf("upgrade: %v", err)
+	}
+	defer conns[0].Close()
+	fc, err := conns[1].(*net.UnixConn).File()
+	conns[1].Close()
+	if err != nil {
+		return fmt.Errorf("upgrade: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), upgradeEnv+"=3")
+	cmd.ExtraFiles, cmd.Stdout, cmd.Stderr = []*os.File{fc}, os.Stdout, os.Stderr
+	err = cmd.Start()
+	fc.Close()
+	if err != nil {
+		return fmt.Errorf("upgrade: unable to start process: %v", err)
+	}
+
+	uf, err := conns[0].(*net.UnixConn).File()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("upgrade: %v", err)
+	}
+	defer uf.Close()
+	fd := int(uf.Fd())
+
+	readyCh := make(chan error, 1)
+	go func() {
+		for i, f := range files {
+			if f == nil {
+				continue
+			}
+			if err := WriteMsg(fd, &Msg{Type: MsgListener, Payload: []byte(strconv.Itoa(i)), File: f}); err != nil {
+				readyCh <- err
+				return
+			}
+		}
+		if err := WriteMsg(fd, &Msg{Type: MsgReady}); err != nil {
+			readyCh <- err
+			return
+		}
+		m, err := ReadMsg(fd, "upgrade")
+		if err == nil && m.Type != MsgReady {
+			err = fmt.Errorf("unexpected message %d", m.Type)
+		}
+		readyCh <- err
+	}()
+
+	select {
+	case err = <-readyCh:
+	case <-time.After(u.Timeout):
+		err = fmt.Errorf("not ready after %s", u.Timeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("upgrade: process %d: %v", cmd.Process.Pid, err)
+	}
+
+	fmt.Printf("upgraded to process %d\n", cmd.Process.Pid)
+	cmd.Process.Release()
+	u.upgraded.Store(true)
+	if u.OnReady != nil {
+		u.OnReady()
+	}
+	return nil
+}
+
+// inherit takes over the listeners handed to us when started by
+// Upgrade. The returned file is used to tell the old process that we
+// are ready, it's nil if we weren't started by Upgrade.
+func inherit(connections []*Connection) (*os.File, error) {
+	v := os.Getenv(upgradeEnv)
+	if v == "" {
+		return nil, nil
+	}
+	// Don't let forked children think that they are upgrading too.
+	os.Unsetenv(upgradeEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: %s: %v", upgradeEnv, err)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+
+	for {
+		m, err := ReadMsg(fd, "listener")
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("upgrade: %v", err)
+		}
+		if m.Type == MsgReady {
+			return f, nil
+		}
+
+		i, err := strconv.Atoi(string(m.Payload))
+		if m.Type != MsgListener || m.File == nil || err != nil || i < 0 || i >= len(connections) {
+			f.Close()
+			return nil, fmt.Errorf("upgrade: unexpected message %d: %q", m.Type, m.Payload)
+		}
+		connections[i].Listen.inherited = m.File
+	}
+}
+
+// ready tells the old process that it can drain. Under systemd we are
+// the main process from now on, this needs NotifyAccess=all.
+func ready(f *os.File) error {
+	defer f.Close()
+	if err := WriteMsg(int(f.Fd()), &Msg{Type: MsgReady}); err != nil {
+		return fmt.Errorf("upgrade: %v", err)
+	}
+	if _, err := daemon.SdNotify(false, fmt.Sprintf("MAINPID=%d", os.Getpid())); err != nil {
+		return fmt.Errorf("upgrade: sd_notify: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInherit(t *testing.T) {
+	conns, err := UnixPipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conns[0].Close()
+	defer conns[1].Close()
+
+	listen := func() Listen {
+		return Listen{Addr: &Addr{Addr: "127.0.0.1:0"}, Protocol: "tcp", TLS: ListenTLS{ClientTLS: &ClientTLS{}}}
+	}
+
+	old := listen()
+	ln, err := old.Listener()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer ln.Close()
+
+	file, err := old.ListenerFile()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+
+	if err := WriteMsgConn(conns[0].(*net.UnixConn), &Msg{Type: MsgListener, Payload: []byte("1"), File: file}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := WriteMsgConn(conns[0].(*net.UnixConn), &Msg{Type: MsgReady}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	fc, err := conns[1].(*net.UnixConn).File()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fd, err := syscall.Dup(int(fc.Fd()))
+	fc.Close()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Setenv(upgradeEnv, strconv.Itoa(fd))
+
+	connections := []*Connection{
+		{Listen: listen()},
+		{Listen: listen()},
+	}
+	f, err := inherit(connections)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if f == nil {
+		t.Fatalf("inherit didn't return the upgrade channel")
+	}
+	f.Close()
+
+	if connections[0].Listen.inherited != nil {
+		t.Fatalf("connection 0 inherited a listener")
+	}
+	newLn, err := connections[1].Listen.Listener()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer newLn.Close()
+
+	if newLn.Addr().String() != ln.Addr().String() {
+		t.Fatalf("addr(%s) != %s", newLn.Addr(), ln.Addr())
+	}
+}
+
+// echo accepts on ln and writes back what it reads.
+func echo(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// roundTrip sends payload to addr, retrying until it's accepted, and
+// reads it back.
+func roundTrip(addr, payload string) error {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != payload {
+		return fmt.Errorf("got %q", buf)
+	}
+	return nil
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// TestUpgradeE2E upgrades a process with a connection that listens in
+// the process and one that listens and dials in forked children.
+func TestUpgradeE2E(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer backend.Close()
+	go echo(backend)
+
+	simple, fork := freeAddr(t), freeAddr(t)
+	client := "--client.addr=" + backend.Addr().String()
+	args := []string{"-test.run", "^TestE2EBin$", "-test.timeout", "20s", "--",
+		"--name=simple", "--listen.addr=" + simple, client, "--drain-timeout=1s", "--next",
+		"--name=fork", "--listen.addr=" + fork, "--listen.fork", "--client.fork", client, "--drain-timeout=1s"}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = []string{"CMD_TEST_E2E=1"}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer cmd.Process.Kill()
+
+	upgraded := make(chan int, 1)
+	go func() {
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			fmt.Println(scanner.Text())
+			var pid int
+			if _, err := fmt.Sscanf(scanner.Text(), "upgraded to process %d", &pid); err == nil {
+				upgraded <- pid
+			}
+		}
+	}()
+
+	for _, addr := range []string{simple, fork} {
+		if err := roundTrip(addr, "before"); err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatalf("%v", err)
+	}
+	select {
+	case pid := <-upgraded:
+		defer syscall.Kill(pid, syscall.SIGINT)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("not upgraded")
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("old process: %v", err)
+	}
+
+	for _, addr := range []string{simple, fork} {
+		if err := roundTrip(addr, "after"); err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+	}
+}
@@ -7,14 +7,42 @@ import (
 )
 
 type User struct {
-	User  string `long:"user" description:"change to user on listen thread"`
-	Group string `long:"group" description:"change to group on listen thread"`
-	UID   int    `long:"uid" description:"change user on listen thread"`
-	GID   int    `long:"gid" description:"change group on listen thread"`
+	User   string   `long:"user" description:"change to user on listen thread"`
+	Group  string   `long:"group" description:"change to group on listen thread"`
+	UID    int      `long:"uid" description:"change user on listen thread"`
+	GID    int      `long:"gid" description:"change group on listen thread"`
+	Groups []string `long:"groups" description:"supplementary groups, names or gids, added to those of user"`
+
+	// groups are the supplementary gids, those of User and Groups.
+	groups []int
+}
+
+func lookupGid(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	lg, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	gidInt32, err := strconv.ParseInt(lg.Gid, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int(gidInt32), nil
+}
+
+func (u *User) addGroup(gid int) {
+	for _, g := range u.groups {
+		if g == gid {
+			return
+		}
+	}
+	u.groups = append(u.groups, gid)
 }
 
 func (u *User) Lookup() error {
-	var uid, gid int
+	uid, gid := u.UID, u.GID
 	if u.UID == 0 && u.User != "" {
 		lu, err := user.Lookup(u.User)
 		if err != nil {
@@ -29,24 +57,42 @@ func (u *User) Lookup() error {
 			return err
 		}
 
+		// The groups the user is a member of, like a login gets.
+		ids, err := lu.GroupIds()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			g, err := strconv.Atoi(id)
+			if err != nil {
+				return err
+			}
+			u.addGroup(g)
+		}
+
 		uid = int(uidInt32)
 		gid = int(gidInt32)
 		u.User = ""
 	}
 
 	if u.GID == 0 && u.Group != "" {
-		lg, err := user.LookupGroup(u.Group)
+		g, err := lookupGid(u.Group)
 		if err != nil {
 			return err
 		}
-		gidInt32, err := strconv.ParseInt(lg.Gid, 10, 32)
+
+		gid = g
+		u.Group = ""
+	}
+
+	for _, group := range u.Groups {
+		g, err := lookupGid(group)
 		if err != nil {
 			return err
 		}
-
-		gid = int(gidInt32)
-		u.Group = ""
+		u.addGroup(g)
 	}
+	u.Groups = nil
 
 	u.UID, u.GID = uid, gid
 	return nil
@@ -57,11 +103,13 @@ func (u *User) Switch() error {
 		return err
 	}
 
-	if u.GID > 0 {
-		if err := syscall.Setgroups([]int{}); err != nil {
+	if u.GID > 0 || len(u.groups) > 0 {
+		if err := syscall.Setgroups(u.groups); err != nil {
 			return err
 		}
+	}
 
+	if u.GID > 0 {
 		if err := syscall.Setgid(u.GID); err != nil {
 			return err
 		}
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	subuidFile = "/etc/subuid"
+	subgidFile = "/etc/subgid"
+)
+
+// parseIDMap takes inside:outside:count, as in /proc/self/uid_map.
+func parseIDMap(s string) (syscall.SysProcIDMap, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return syscall.SysProcIDMap{}, fmt.Errorf("id map %q is not inside:outside:count", s)
+	}
+	ids := [3]int{}
+	for i, p := range parts {
+		id, err := strconv.Atoi(p)
+		if err != nil || id < 0 {
+			return syscall.SysProcIDMap{}, fmt.Errorf("id map %q: %q is not an id", s, p)
+		}
+		ids[i] = id
+	}
+	if ids[2] == 0 {
+		return syscall.SysProcIDMap{}, fmt.Errorf("id map %q maps nothing", s)
+	}
+	return syscall.SysProcIDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}, nil
+}
+
+// readSubids returns the first range of name, or of id, in a file like
+// /etc/subuid, mapped from 0 in the namespace.
+func readSubids(path, name string, id int) (syscall.SysProcIDMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return syscall.SysProcIDMap{}, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || (parts[0] != name && parts[0] != strconv.Itoa(id)) {
+			continue
+		}
+		m, err := parseIDMap("0:" + parts[1] + ":" + parts[2])
+		if err != nil {
+			return m, fmt.Errorf("%s: %v", path, err)
+		}
+		return m, nil
+	}
+	if err := s.Err(); err != nil {
+		return syscall.SysProcIDMap{}, err
+	}
+	return syscall.SysProcIDMap{}, fmt.Errorf("%s: no range for %s", path, name)
+}
+
+// idMaps returns the uid and gid mappings of the user namespace of a
+// forked child: the subordinate ids of UsernsSubids, then the ones
+// given one by one.
+func (p *Proc) idMaps() (uids, gids []syscall.SysProcIDMap, err error) {
+	if p.UsernsSubids != "" {
+		lu, err := user.Lookup(p.UsernsSubids)
+		if err != nil {
+			lu, err = user.LookupId(p.UsernsSubids)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("userns.subids: %v", err)
+		}
+		id, _ := strconv.Atoi(lu.Uid)
+		uid, err := readSubids(subuidFile, lu.Username, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		gid, err := readSubids(subgidFile, lu.Username, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		uids, gids = append(uids, uid), append(gids, gid)
+	}
+	for _, s := range p.UsernsUidMap {
+		m, err := parseIDMap(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		uids = append(uids, m)
+	}
+	for _, s := range p.UsernsGidMap {
+		m, err := parseIDMap(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		gids = append(gids, m)
+	}
+	return uids, gids, nil
+}
+
+// idMapped tells if id in the namespace is mapped to one outside.
+func idMapped(maps []syscall.SysProcIDMap, id int) bool {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return true
+		}
+	}
+	return false
+}
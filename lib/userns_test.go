@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestParseIDMap(t *testing.T) {
+	m, err := parseIDMap("0:100000:65536")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if m != (syscall.SysProcIDMap{ContainerID: 0, HostID: 100000, Size: 65536}) {
+		t.Errorf("got %+v", m)
+	}
+	for _, s := range []string{"0:100000", "0:a:1", "0:-1:1", "0:100000:0"} {
+		if _, err := parseIDMap(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestProcPrepareIDMaps(t *testing.T) {
+	dir := t.TempDir()
+	subuidFile, subgidFile = filepath.Join(dir, "subuid"), filepath.Join(dir, "subgid")
+	defer func() { subuidFile, subgidFile = "/etc/subuid", "/etc/subgid" }()
+	if err := os.WriteFile(subuidFile, []byte("# comment\nother:200000:65536\nroot:100000:65536\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.WriteFile(subgidFile, []byte("0:300000:1000\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cmd := exec.Command("true")
+	p := &Proc{Sandbox: "none", SandboxEnable: []string{"users"}, UsernsSubids: "root"}
+	if _, err := p.Prepare(cmd, &User{}, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	attr := cmd.SysProcAttr
+	if len(attr.UidMappings) != 1 || attr.UidMappings[0].HostID != 100000 || attr.UidMappings[0].Size != 65536 {
+		t.Errorf("uid mappings %+v", attr.UidMappings)
+	}
+	if len(attr.GidMappings) != 1 || attr.GidMappings[0].HostID != 300000 || attr.GidMappings[0].Size != 1000 {
+		t.Errorf("gid mappings %+v", attr.GidMappings)
+	}
+	if attr.Credential == nil || attr.Credential.Uid != 0 {
+		t.Errorf("root in the namespace isn't switched to: %+v", attr.Credential)
+	}
+
+	// The default profile gets a user namespace when ids are mapped.
+	cmd = exec.Command("true")
+	p = &Proc{Sandbox: "default", UsernsSubids: "root"}
+	if _, err := p.Prepare(cmd, &User{UID: 1000, GID: 999}, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWUSER == 0 {
+		t.Errorf("no user namespace: %#x", cmd.SysProcAttr.Cloneflags)
+	}
+
+	p = &Proc{Sandbox: "default", UsernsSubids: "root"}
+	if _, err := p.Prepare(exec.Command("true"), &User{UID: 1000, GID: 1000}, nil); err == nil {
+		t.Errorf("unmapped gid accepted")
+	}
+
+	p = &Proc{Sandbox: "default", SandboxDisable: []string{"users"}, UsernsUidMap: []string{"0:100000:1"}, UsernsGidMap: []string{"0:100000:1"}}
+	if _, err := p.Prepare(exec.Command("true"), &User{}, nil); err == nil {
+		t.Errorf("maps without a user namespace accepted")
+	}
+
+	p = &Proc{Sandbox: "default", UsernsUidMap: []string{"0:100000:1"}}
+	if _, err := p.Prepare(exec.Command("true"), &User{}, nil); err == nil {
+		t.Errorf("uids mapped without gids accepted")
+	}
+}